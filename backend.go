@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// SearchBackend is the search cluster documents are indexed into. Each value reads and writes a single
+// index (or alias), but the cluster-level operations used to build and swap indices take index names.
+type SearchBackend interface {
+	// Index returns the name of the index this backend reads and writes
+	Index() string
+
+	// WithIndex returns a backend sharing the same connection which reads and writes the given index instead
+	WithIndex(index string) SearchBackend
+
+	searchSink
+
+	// Ping checks that the cluster is reachable and not reporting red status
+	Ping(ctx context.Context) error
+
+	// CreateIndex creates a new index with the bundled settings and mappings
+	CreateIndex(ctx context.Context, index string) error
+
+	// CountDocuments refreshes the given index and returns how many documents of the given types it holds
+	CountDocuments(ctx context.Context, index string, docTypes ...string) (int64, error)
+
+	// AliasedIndices returns the indices behind the given alias. If name is a concrete index rather
+	// than an alias, it's returned with isIndex set. Nothing is returned if it doesn't exist at all.
+	AliasedIndices(ctx context.Context, name string) (indices []string, isIndex bool, err error)
+
+	// SwapAlias atomically points alias at index instead of the old indices. If the alias name is
+	// currently taken by a concrete index, that index is deleted in the same operation.
+	SwapAlias(ctx context.Context, alias, index string, old []string, replaceIndex bool) error
+
+	// DeleteIndices deletes the given indices
+	DeleteIndices(ctx context.Context, indices ...string) error
+
+	// GetMappings returns the mappings of each of the given indices, keyed by index name
+	GetMappings(ctx context.Context, indices ...string) (map[string]map[string]interface{}, error)
+
+	// GetAnalysis returns the analysis settings of each of the given indices, keyed by index name
+	GetAnalysis(ctx context.Context, indices ...string) (map[string]map[string]interface{}, error)
+
+	// Close releases the connection
+	Close()
+}
+
+// searchSink is the part of a SearchBackend that reindexing reads documents from and writes them to
+type searchSink interface {
+	// SearchAll pages through every hit for query, a query in the Elasticsearch query DSL, fetching only
+	// the given source fields. Each page is passed to fn along with the total number of hits; if fn
+	// returns an error, paging stops and it's returned.
+	SearchAll(ctx context.Context, query searchQuery, fields []string, fn func(total int64, hits []searchHit) error) error
+
+	// NewBulkIndexer returns a bulkIndexer writing to the sink's index, flushing every bulkSize requests
+	NewBulkIndexer(ctx context.Context, bulkSize int) bulkIndexer
+}
+
+// searchQuery is a query in the Elasticsearch query DSL, which OpenSearch shares
+type searchQuery map[string]interface{}
+
+// searchHit is a single document returned from a search
+type searchHit struct {
+	ID     string
+	Source json.RawMessage
+}
+
+// bulkIndexer batches index and delete requests against a single index, so writes can be swapped out (e.g. for dry runs)
+type bulkIndexer interface {
+	// Index adds a request to index the given JSON document under id, flushing if the batch is full
+	Index(id, doc string) error
+
+	// Delete adds a request to delete the document with the given id, flushing if the batch is full
+	Delete(id string) error
+
+	CanFlush() bool
+	Flush() error
+}
+
+// flushIfPending flushes any requests still batched in indexer. Flushing an empty batch is an error for
+// some backends, so it's skipped.
+func flushIfPending(indexer bulkIndexer) error {
+	if !indexer.CanFlush() {
+		return nil
+	}
+	return indexer.Flush()
+}
+
+// searchPageSize is how many hits are fetched per page when paging through search results
+const searchPageSize = 1000
+
+// pitKeepAlive is how long a point in time is kept open between pages
+const pitKeepAlive = "2m"
+
+// docTypesQuery matches documents with any of the given doc_type values
+func docTypesQuery(docTypes ...string) searchQuery {
+	return searchQuery{"terms": map[string]interface{}{"doc_type": docTypes}}
+}
+
+// SetupSearchBackend connects to the configured kind of search cluster, either "elasticsearch" or "opensearch"
+func SetupSearchBackend(kind, base, user, password, index string) (SearchBackend, error) {
+	switch kind {
+	case "", "elasticsearch":
+		return SetupES(base, user, password, index)
+	case "opensearch":
+		return SetupOpenSearch(base, user, password, index)
+	default:
+		return nil, errors.Errorf("Unknown search backend %q, expected elasticsearch or opensearch", kind)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// tagsCheckpoint is the run ledger entry recorded once a full run has reindexed tags
+const tagsCheckpoint = "tags"
+
+// resumableRuns is how many recent runs to look through for one to resume
+const resumableRuns = 20
+
+// checkpoint is the work an interrupted full reindex run had completed, as recorded in the run ledger, so
+// the run can be resumed from any replica. A nil *checkpoint is valid and has nothing completed.
+type checkpoint struct {
+	runID string
+	done  map[string]bool
+}
+
+// newCheckpoint returns the checkpoint for a run from its ledger entries. Split prefixes aren't counted as
+// done, since their sub-prefixes may not all have completed.
+func newCheckpoint(runID string, entries map[string]ledgerEntry) *checkpoint {
+	c := &checkpoint{runID: runID, done: make(map[string]bool)}
+	for prefix, e := range entries {
+		if e.Status == prefixCompleted {
+			c.done[prefix] = true
+		}
+	}
+	return c
+}
+
+// loadCheckpoint loads the checkpoint for the given run from the ledger, or for the most recent unfinished
+// run if runID is empty. It returns nil if there's no unfinished run to resume.
+func loadCheckpoint(ctx context.Context, ledger *runLedger, runID string) (*checkpoint, error) {
+	if ledger == nil {
+		return nil, errors.New("Resuming needs the run ledger, enable infosquito.run_ledger")
+	}
+
+	if runID == "" {
+		runs, err := ledger.Runs(ctx, resumableRuns)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range runs {
+			if !r.DryRun && !r.Done() {
+				runID = r.RunID
+				break
+			}
+		}
+		if runID == "" {
+			log.Warn("No unfinished run found to resume, starting from the beginning")
+			return nil, nil
+		}
+	}
+
+	_, entries, err := ledger.Prefixes(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.Errorf("No prefixes recorded for run %s", runID)
+	}
+
+	c := newCheckpoint(runID, entries)
+	log.Infof("Resuming run %s with %d completed entries", runID, len(c.done))
+	return c, nil
+}
+
+// RunID returns the ID of the run being resumed, if any
+func (c *checkpoint) RunID() string {
+	if c == nil {
+		return ""
+	}
+	return c.runID
+}
+
+// Done returns true if the given entry, or any prefix of it, has been completed
+func (c *checkpoint) Done(entry string) bool {
+	if c == nil {
+		return false
+	}
+	for i := len(entry); i > 0; i-- {
+		if c.done[entry[:i]] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewCheckpoint(t *testing.T) {
+	c := newCheckpoint("run-1", map[string]ledgerEntry{
+		tagsCheckpoint: {Status: prefixCompleted},
+		"000":          {Status: prefixCompleted},
+		"001":          {Status: prefixSplit},
+		"0011":         {Status: prefixCompleted},
+		"002":          {Status: prefixFailed},
+		"003":          {Status: prefixQueued},
+	})
+
+	if c.RunID() != "run-1" {
+		t.Errorf("Got run ID %q instead of expected %q", c.RunID(), "run-1")
+	}
+
+	cases := []struct {
+		entry    string
+		expected bool
+	}{
+		{tagsCheckpoint, true},
+		{"000", true},
+		{"000a", true},
+		{"001", false},
+		{"0011", true},
+		{"0012", false},
+		{"002", false},
+		{"003", false},
+	}
+	for _, tc := range cases {
+		if got := c.Done(tc.entry); got != tc.expected {
+			t.Errorf("Done(%q) = %t, expected %t", tc.entry, got, tc.expected)
+		}
+	}
+}
+
+func TestNilCheckpoint(t *testing.T) {
+	var c *checkpoint
+	if c.Done("000") {
+		t.Error("Expected a nil checkpoint to have nothing done")
+	}
+	if c.RunID() != "" {
+		t.Errorf("Expected a nil checkpoint to have no run ID, got %q", c.RunID())
+	}
+}
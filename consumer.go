@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/messaging/v12"
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// consumerReconnectDelay is how long to wait before reconnecting after the consumer's connection is lost
+const consumerReconnectDelay = 5 * time.Second
+
+// queueConsumer delivers messages from the service's queue to a handler, each in its own goroutine. Unlike
+// the messaging client's consumers it can be canceled, so the broker stops sending messages while the
+// in-flight ones are finished and acknowledged on the same channel.
+type queueConsumer struct {
+	uri          string
+	exchange     string
+	exchangeType string
+	queue        string
+	keys         []string
+	prefetch     int
+	handler      func(context.Context, amqp.Delivery)
+
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	tag      string
+	canceled bool
+}
+
+// run consumes messages until the consumer is canceled, reconnecting whenever the connection is lost
+func (c *queueConsumer) run() {
+	for {
+		err := c.consume()
+		if c.isCanceled() {
+			return
+		}
+		if err != nil {
+			log.Error(errors.Wrapf(err, "Consuming from %s failed", c.queue))
+		} else {
+			log.Warnf("Lost the connection consuming from %s", c.queue)
+		}
+		time.Sleep(consumerReconnectDelay)
+	}
+}
+
+func (c *queueConsumer) isCanceled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.canceled
+}
+
+// consume sets up the queue and hands off deliveries until the delivery channel is closed
+func (c *queueConsumer) consume() error {
+	conn, err := amqp.Dial(c.uri)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		logIfErr(conn.Close, "closing AMQP connection")
+		return err
+	}
+
+	deliveries, err := c.setup(ch)
+	if err != nil {
+		logIfErr(conn.Close, "closing AMQP connection")
+		return err
+	}
+
+	c.mu.Lock()
+	if c.canceled {
+		c.mu.Unlock()
+		logIfErr(conn.Close, "closing AMQP connection")
+		return nil
+	}
+	if c.conn != nil {
+		logIfErr(c.conn.Close, "closing old AMQP connection")
+	}
+	c.conn, c.ch = conn, ch
+	c.mu.Unlock()
+
+	log.Infof("Consuming from %s", c.queue)
+	for del := range deliveries {
+		go c.handle(del)
+	}
+	return nil
+}
+
+// setup declares and binds the queue, then starts consuming from it
+func (c *queueConsumer) setup(ch *amqp.Channel) (<-chan amqp.Delivery, error) {
+	if err := ch.Qos(c.prefetch, 0, false); err != nil {
+		return nil, errors.Wrap(err, "Failed setting the prefetch count")
+	}
+	if err := ch.ExchangeDeclare(c.exchange, c.exchangeType, true, false, false, false, nil); err != nil {
+		return nil, errors.Wrapf(err, "Failed declaring exchange %s", c.exchange)
+	}
+	if _, err := ch.QueueDeclare(c.queue, true, false, false, false, nil); err != nil {
+		return nil, errors.Wrapf(err, "Failed declaring queue %s", c.queue)
+	}
+	for _, key := range c.keys {
+		if err := ch.QueueBind(c.queue, key, c.exchange, false, nil); err != nil {
+			return nil, errors.Wrapf(err, "Failed binding %s to queue %s", key, c.queue)
+		}
+	}
+	return ch.Consume(c.queue, c.tag, false, false, false, false, nil)
+}
+
+// handle runs the handler for a delivery in a span continuing the trace it was published with
+func (c *queueConsumer) handle(del amqp.Delivery) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), messaging.AMQPHeaderCarrier(del.Headers))
+	ctx, span := otel.Tracer(otelName).Start(ctx, c.queue+" process", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+
+	c.handler(ctx, del)
+}
+
+// cancel asks the broker to stop sending messages. Deliveries already received can still be acknowledged.
+func (c *queueConsumer) cancel() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.canceled = true
+	if c.ch == nil {
+		return nil
+	}
+	return c.ch.Cancel(c.tag, false)
+}
+
+// check reports whether the consumer is connected, for the readiness check
+func (c *queueConsumer) check(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil || c.conn.IsClosed() {
+		return fmt.Errorf("not connected to consume from %s", c.queue)
+	}
+	return nil
+}
+
+// Close closes the connection, requeueing anything still unacknowledged
+func (c *queueConsumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.canceled = true
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cyverse-de/messaging/v12"
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// deadLetterRoutingKey is what dead letters are published with. It's outside of index.# so the main queue never sees them.
+const deadLetterRoutingKey = "infosquito2.dead-letter"
+
+// deadLetter is the body of a message in the dead-letter queue
+type deadLetter struct {
+	RoutingKey string    `json:"routing_key"`
+	Body       string    `json:"body,omitempty"`
+	Reason     string    `json:"reason"`
+	Attempts   int       `json:"attempts"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+// deadLetterQueue holds messages which failed too many times, or could never succeed, for an operator to look at
+type deadLetterQueue struct {
+	client *messaging.Client
+	name   string
+}
+
+func getDeadLetterQueueName(prefix string) string {
+	return fmt.Sprintf("%s.dead-letter", getQueueName(prefix))
+}
+
+// channel declares the queue and binds it to the exchange if needed, returning a channel to work with it
+func (q *deadLetterQueue) channel() (*amqp.Channel, error) {
+	return q.client.CreateQueue(q.name, amqpExchangeName, deadLetterRoutingKey, true, false)
+}
+
+// setup makes sure the queue exists so dead letters aren't dropped before anyone lists them
+func (q *deadLetterQueue) setup() error {
+	ch, err := q.channel()
+	if err != nil {
+		return err
+	}
+	return ch.Close()
+}
+
+// publish sends a message to the dead-letter queue along with why it's there
+func (q *deadLetterQueue) publish(ctx context.Context, del amqp.Delivery, attempts int, reason string) error {
+	body, err := json.Marshal(deadLetter{
+		RoutingKey: del.RoutingKey,
+		Body:       string(del.Body),
+		Reason:     reason,
+		Attempts:   attempts,
+		FailedAt:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	deadLettersTotal.WithLabelValues(messageKind(del.RoutingKey)).Inc()
+	log.Warnf("Dead-lettering %s after %d attempts: %s", del.RoutingKey, attempts, reason)
+	return q.client.PublishContextOpts(ctx, deadLetterRoutingKey, body, messaging.JSONPublishingOpts)
+}
+
+// list returns the dead letters without removing them from the queue
+func (q *deadLetterQueue) list() ([]deadLetter, error) {
+	ch, err := q.channel()
+	if err != nil {
+		return nil, err
+	}
+	// closing the channel requeues everything fetched without acknowledging it
+	defer logIfErr(ch.Close, "closing dead-letter channel")
+
+	var letters []deadLetter
+	for {
+		d, ok, err := ch.Get(q.name, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		var letter deadLetter
+		if err = json.Unmarshal(d.Body, &letter); err != nil {
+			letter = deadLetter{Reason: fmt.Sprintf("unreadable dead letter: %s", err)}
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// replay republishes each dead letter with its original routing key and a reset attempt count, removing it from the queue
+func (q *deadLetterQueue) replay(ctx context.Context) (int, error) {
+	ch, err := q.channel()
+	if err != nil {
+		return 0, err
+	}
+	defer logIfErr(ch.Close, "closing dead-letter channel")
+
+	replayed := 0
+	for {
+		d, ok, err := ch.Get(q.name, false)
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			return replayed, nil
+		}
+
+		var letter deadLetter
+		if err = json.Unmarshal(d.Body, &letter); err != nil || letter.RoutingKey == "" {
+			log.Errorf("Discarding unreadable dead letter: %s", d.Body)
+			logIfErr(func() error { return d.Ack(false) }, "acknowledging unreadable dead letter")
+			continue
+		}
+
+		// published without the attempt header, so the replay gets a full set of retries
+		if err = q.client.PublishContext(ctx, letter.RoutingKey, []byte(letter.Body)); err != nil {
+			return replayed, errors.Wrapf(err, "Failed replaying %s", letter.RoutingKey)
+		}
+		if err = d.Ack(false); err != nil {
+			return replayed, errors.Wrapf(err, "Failed acknowledging replayed %s", letter.RoutingKey)
+		}
+		log.Infof("Replayed dead letter %s", letter.RoutingKey)
+		replayed++
+	}
+}
+
+// printDeadLetters writes a table of dead letters
+func printDeadLetters(w io.Writer, letters []deadLetter) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTING KEY\tATTEMPTS\tFAILED\tREASON")
+	for _, l := range letters {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", l.RoutingKey, l.Attempts, l.FailedAt.Format(time.RFC3339), l.Reason)
+	}
+	return tw.Flush()
+}
+
+// showDeadLetters lists the dead letters for the dead-letters mode, or republishes them if replay is set
+func showDeadLetters(ctx context.Context, w io.Writer, replay bool) error {
+	loadAMQPConfig()
+
+	client, err := messaging.NewClient(amqpURI, false)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create the messaging client")
+	}
+	defer client.Close()
+
+	if err = client.SetupPublishing(amqpExchangeName); err != nil {
+		return errors.Wrap(err, "Unable to set up message publishing")
+	}
+
+	q := &deadLetterQueue{client: client, name: getDeadLetterQueueName(amqpQueuePrefix)}
+	if replay {
+		n, err := q.replay(ctx)
+		fmt.Fprintf(w, "Replayed %d dead letters\n", n)
+		return err
+	}
+
+	letters, err := q.list()
+	if err != nil {
+		return err
+	}
+	return printDeadLetters(w, letters)
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"database/sql"
 
 	"github.com/cyverse-de/dbutil"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 )
 
 // DEDBConnection wraps a sql.DB for the DEDB
@@ -24,8 +26,13 @@ type DEDBTx struct {
 	schema string
 }
 
-// SetupDEDB initializes an DEDBConnection for the given dbURI
-func SetupDEDB(dbURI, schema string) (*DEDBConnection, error) {
+// SetupDEDB initializes an DEDBConnection for the given dbURI, allowing up to maxConns open connections.
+// The schema is formatted into queries, so it must be a plain lowercase identifier.
+func SetupDEDB(dbURI, schema string, maxConns int) (*DEDBConnection, error) {
+	if err := checkSchema(schema); err != nil {
+		return nil, err
+	}
+
 	connector, err := dbutil.NewDefaultConnector("1m")
 	if err != nil {
 		return nil, err
@@ -43,12 +50,22 @@ func SetupDEDB(dbURI, schema string) (*DEDBConnection, error) {
 	}
 	log.Info("Successfully pinged the database")
 
-	db.SetMaxOpenConns(10)
+	db.SetMaxOpenConns(maxConns)
 	db.SetConnMaxIdleTime(time.Minute)
 
 	return &DEDBConnection{db: db, schema: schema}, nil
 }
 
+// Close closes the underlying sql.DB
+func (d *DEDBConnection) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database is still reachable
+func (d *DEDBConnection) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 // BeginTx starts an DEDBTx for the given DEDBConnection
 func (d *DEDBConnection) BeginTx(ctx context.Context, opts *sql.TxOptions) (*DEDBTx, error) {
 	tx, err := d.db.BeginTx(ctx, opts)
@@ -63,6 +80,10 @@ func (d *DEDBConnection) BeginTx(ctx context.Context, opts *sql.TxOptions) (*DED
 
 // CreateTemporaryTable creates a temporary table set to ON COMMIT DROP for the given name and query on the given DEDBTx
 func (tx *DEDBTx) CreateTemporaryTable(ctx context.Context, name string, query string, args ...interface{}) (int64, error) {
+	if err := checkTemporaryTables(name); err != nil {
+		return 0, err
+	}
+
 	res, err := tx.tx.ExecContext(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE %s ON COMMIT DROP AS %s", name, query), args...)
 	if err != nil {
 		return 0, err
@@ -80,6 +101,13 @@ func (tx *DEDBTx) CreateTemporaryTable(ctx context.Context, name string, query s
 	return rowsAffected, nil
 }
 
+// CountTags returns how many tags there are, which is how many tag documents a full reindex should produce
+func (d *DEDBConnection) CountTags(ctx context.Context) (int64, error) {
+	var count int64
+	err := d.db.QueryRowContext(ctx, fmt.Sprintf("SELECT count(*) FROM %s.tags", d.schema)).Scan(&count)
+	return count, err
+}
+
 // GetTags returns a sql.Rows for all tags
 func (tx *DEDBTx) GetTags(ctx context.Context, irodsZone string) (*sql.Rows, error) {
 	query := fmt.Sprintf(`WITH attached (tag_id, targets) AS (
@@ -87,29 +115,47 @@ SELECT tag_id,
        json_agg(format('{"id": %%s, "type": %%s}',
            coalesce(to_json(a_t.target_id::text), 'null'::json),
 	   coalesce(to_json(a_t.target_type::text), 'null'::json))::json) "targets"
-  FROM attached_tags a_t WHERE a_t.target_type IN ('file', 'folder') GROUP BY a_t.tag_id
+  FROM %[1]s.attached_tags a_t WHERE a_t.target_type IN ('file', 'folder') GROUP BY a_t.tag_id
 )
 SELECT id, to_json(q.*) FROM (
 SELECT t.id::text,
        'tag' "doc_type",
        t.value,
        t.description,
-       t.owner_id || '#%[1]s' "creator",
+       t.owner_id || '#' || $1 "creator",
        t.created_on "dateCreated",
        t.modified_on "dateModified",
        coalesce(attached.targets, json_build_array()) "targets"
-  FROM %[2]s.tags t
-  LEFT JOIN attached ON (t.id = attached.tag_id)) q ORDER BY id`, irodsZone, tx.schema)
+  FROM %[1]s.tags t
+  LEFT JOIN attached ON (t.id = attached.tag_id)) q ORDER BY id`, tx.schema)
 	log.Debugf("Tags query: %s", query)
-	return tx.tx.QueryContext(ctx, query)
+	return tx.tx.QueryContext(ctx, query, irodsZone)
 }
 
-// GetAVUs returns a sql.Rows for CyVerse metadata AVUs with an optional UUID prefix for the ultimate target ID (but still including nested AVUs)
+// GetAVUs returns a sql.Rows for CyVerse metadata AVUs with an optional hexadecimal UUID prefix for the ultimate target ID (but still including nested AVUs)
 func (tx *DEDBTx) GetAVUs(ctx context.Context, rootTargetIdPrefix string) (*sql.Rows, error) {
-	var where string
-	if rootTargetIdPrefix != "" {
-		where = fmt.Sprintf("WHERE target_id::text LIKE '%s%%'", rootTargetIdPrefix)
+	if rootTargetIdPrefix == "" {
+		return tx.getAVUs(ctx, "")
+	}
+	if !isHexPrefix(rootTargetIdPrefix) {
+		return nil, errors.Errorf("Invalid prefix %q", rootTargetIdPrefix)
 	}
+	return tx.getAVUs(ctx, "WHERE target_id::text LIKE $1 || '%'", strings.ToLower(rootTargetIdPrefix))
+}
+
+// GetAVUsForIDs returns a sql.Rows for CyVerse metadata AVUs whose ultimate target ID is one of the given UUIDs (still including nested AVUs).
+// The uuid column is compared directly so its index is used; IDs which aren't UUIDs can't match and are left out rather than failing the cast.
+func (tx *DEDBTx) GetAVUsForIDs(ctx context.Context, rootTargetIds []string) (*sql.Rows, error) {
+	ids := make([]string, 0, len(rootTargetIds))
+	for _, id := range rootTargetIds {
+		if isUUID(id) {
+			ids = append(ids, id)
+		}
+	}
+	return tx.getAVUs(ctx, "WHERE target_id = ANY($1::uuid[])", pq.Array(ids))
+}
+
+func (tx *DEDBTx) getAVUs(ctx context.Context, where string, args ...interface{}) (*sql.Rows, error) {
 	query := fmt.Sprintf(`WITH RECURSIVE all_avus AS (
 SELECT cast(id as varchar),
        attribute,
@@ -147,5 +193,35 @@ SELECT target_id, json_build_object('cyverse', json_agg(format('{"attribute": %%
   ORDER BY target_id
 `, tx.schema, where, tx.schema)
 	log.Debugf("AVUs query: %s", query)
-	return tx.tx.QueryContext(ctx, query)
+	return tx.tx.QueryContext(ctx, query, args...)
+}
+
+// GetAVUTargetsModifiedSince returns the file and folder UUIDs with CyVerse metadata AVUs created or modified at or after the given time, following nested AVUs to their ultimate target
+func (tx *DEDBTx) GetAVUTargetsModifiedSince(ctx context.Context, since time.Time) ([]string, error) {
+	query := fmt.Sprintf(`WITH RECURSIVE changed AS (
+SELECT target_id, target_type
+  FROM %[1]s.avus
+ WHERE modified_on >= $1 OR created_on >= $1
+UNION
+SELECT avus.target_id, avus.target_type
+  FROM %[1]s.avus
+  JOIN changed c ON (c.target_type = 'avu' AND avus.id = c.target_id)
+)
+SELECT DISTINCT cast(target_id as varchar) FROM changed WHERE target_type IN ('file', 'folder')`, tx.schema)
+
+	rows, err := tx.tx.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer logIfErr(rows.Close, "closing modified AVU target rows")
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
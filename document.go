@@ -37,6 +37,9 @@ type ElasticsearchDocument struct {
 	UserPermissions []UserPermission `json:"userPermissions"`
 }
 
+// documentFields are the source fields fetched from ES to compare against ElasticsearchDocument values
+var documentFields = []string{"doc_type", "id", "path", "label", "creator", "fileType", "dateCreated", "dateModified", "fileSize", "metadata", "userPermissions"}
+
 func metadataEqual(one, two []Metadatum) bool {
 	om := make([]interface{}, len(one))
 	for i := range one {
@@ -63,46 +66,53 @@ func permsEqual(one, two []UserPermission) bool {
 
 // Equal checks if two ElasticsearchDocument values are equivalent for our purposes
 func (doc ElasticsearchDocument) Equal(other ElasticsearchDocument) bool {
+	return len(doc.Diff(other)) == 0
+}
+
+// Diff returns the JSON names of the fields which differ between two ElasticsearchDocument values, or nil if they are equivalent
+func (doc ElasticsearchDocument) Diff(other ElasticsearchDocument) []string {
+	var fields []string
+
 	// User-modifiable fields in rough "likelihood" order
 	if doc.DateModified != other.DateModified {
-		return false
+		fields = append(fields, "dateModified")
 	}
 	if doc.FileSize != other.FileSize {
-		return false
+		fields = append(fields, "fileSize")
 	}
 	if doc.Path != other.Path {
-		return false
+		fields = append(fields, "path")
 	}
 	if doc.Label != other.Label {
-		return false
+		fields = append(fields, "label")
 	}
 
 	// Fields which shouldn't change for the same object
 	if doc.ID != other.ID {
-		return false
+		fields = append(fields, "id")
 	}
 	if doc.Creator != other.Creator {
-		return false
+		fields = append(fields, "creator")
 	}
 	if doc.FileType != other.FileType {
-		return false
+		fields = append(fields, "fileType")
 	}
 	if doc.DateCreated != other.DateCreated {
-		return false
+		fields = append(fields, "dateCreated")
 	}
 
 	// More computationally intensive fields to compare
 	if !metadataEqual(doc.Metadata.IRODS, other.Metadata.IRODS) {
-		return false
+		fields = append(fields, "metadata.irods")
 	}
 
 	if !metadataEqual(doc.Metadata.Cyverse, other.Metadata.Cyverse) {
-		return false
+		fields = append(fields, "metadata.cyverse")
 	}
 
 	if !permsEqual(doc.UserPermissions, other.UserPermissions) {
-		return false
+		fields = append(fields, "userPermissions")
 	}
 
-	return true
+	return fields
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -74,3 +75,43 @@ func TestElasticsearchDocumentEqual(t *testing.T) {
 		})
 	}
 }
+
+func TestElasticsearchDocumentDiff(t *testing.T) {
+	base := ElasticsearchDocument{ID: "12345", Path: "/foo", Label: "foo", Creator: "foo#bar", FileType: "generic", DateCreated: 12345, DateModified: 12346, FileSize: 4444}
+
+	modified := base
+	modified.DateModified = 99999
+	modified.Path = "/bar"
+
+	withPerms := base
+	withPerms.UserPermissions = []UserPermission{UserPermission{"foo#bar", "own"}}
+
+	withCyverse := base
+	withCyverse.Metadata = BothMetadata{Cyverse: []Metadatum{Metadatum{"foo", "bar", "baz"}}}
+
+	cases := []struct {
+		name     string
+		doc1     ElasticsearchDocument
+		doc2     ElasticsearchDocument
+		expected []string
+	}{
+		{"same", base, base, nil},
+		{"modified-and-moved", base, modified, []string{"dateModified", "path"}},
+		{"perms", base, withPerms, []string{"userPermissions"}},
+		{"cyverse-metadata", base, withCyverse, []string{"metadata.cyverse"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res1 := c.doc1.Diff(c.doc2)
+			res2 := c.doc2.Diff(c.doc1)
+			if strings.Join(res1, ",") != strings.Join(res2, ",") {
+				t.Errorf("Got different results for diffs in opposite directions: %v and %v", res1, res2)
+			}
+
+			if strings.Join(res1, ",") != strings.Join(c.expected, ",") {
+				t.Errorf("Got %v instead of expected %v", res1, c.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// dryRunOutput is where dry-run reports are written, one JSON object per line. Logs go to stderr, so this stays machine-readable.
+var (
+	dryRunOutput   io.Writer = os.Stdout
+	dryRunOutputMu sync.Mutex
+)
+
+// plannedAction is a single index, update, or delete that a dry run would have sent to ES
+type plannedAction struct {
+	ID      string `json:"id"`
+	DocType string `json:"doc_type"`
+	Action  string `json:"action"`
+
+	// Fields lists what differs from the indexed document, for updates
+	Fields []string `json:"fields,omitempty"`
+}
+
+// dryRunReport collects the planned actions for one reindex operation (a prefix, the tags, etc.)
+type dryRunReport struct {
+	Scope   string          `json:"scope"`
+	Target  string          `json:"target,omitempty"`
+	Actions []plannedAction `json:"actions"`
+}
+
+func newDryRunReport(scope, target string) *dryRunReport {
+	return &dryRunReport{Scope: scope, Target: target, Actions: []plannedAction{}}
+}
+
+// emit writes the report to dryRunOutput. It does nothing on a nil report, which is what non-dry runs have.
+func (r *dryRunReport) emit() error {
+	if r == nil {
+		return nil
+	}
+
+	dryRunOutputMu.Lock()
+	defer dryRunOutputMu.Unlock()
+	return json.NewEncoder(dryRunOutput).Encode(r)
+}
+
+// plan records the action a classification would lead to, if this is a dry run
+func (rows *rowMetadata) plan(id, docType string, classification DocumentClassification, fields []string) {
+	if rows.report == nil {
+		return
+	}
+
+	switch classification {
+	case IndexDocument:
+		rows.report.Actions = append(rows.report.Actions, plannedAction{ID: id, DocType: docType, Action: "index"})
+	case UpdateDocument:
+		rows.report.Actions = append(rows.report.Actions, plannedAction{ID: id, DocType: docType, Action: "update", Fields: fields})
+	}
+}
+
+// planDelete records a deletion, if this is a dry run
+func (rows *rowMetadata) planDelete(id, docType string) {
+	if rows.report == nil {
+		return
+	}
+	rows.report.Actions = append(rows.report.Actions, plannedAction{ID: id, DocType: docType, Action: "delete"})
+}
+
+// discardIndexer is a bulkIndexer that accepts requests and never sends them anywhere
+type discardIndexer struct{}
+
+func (discardIndexer) Index(id, doc string) error { return nil }
+func (discardIndexer) Delete(id string) error     { return nil }
+func (discardIndexer) CanFlush() bool             { return false }
+func (discardIndexer) Flush() error               { return nil }
+
+// newIndexer returns the bulk indexer to use for a reindex operation given its options
+func newIndexer(ctx context.Context, es searchSink, opts ReindexOptions) bulkIndexer {
+	if opts.DryRun {
+		return discardIndexer{}
+	}
+	return meteredIndexer{es.NewBulkIndexer(ctx, 1000)}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"net/http"
 
 	"github.com/cyverse-de/esutils/v3"
@@ -37,9 +38,205 @@ func SetupES(base, user, password, index string) (*ESConnection, error) {
 	return &ESConnection{es: c, index: index}, nil
 }
 
-// NewBulkIndexer returns an esutils.BulkIndexer given a size and a connection
-func (es *ESConnection) NewBulkIndexer(context context.Context, bulkSize int) *esutils.BulkIndexer {
-	return esutils.NewBulkIndexerContext(context, es.es, bulkSize)
+// esBulkIndexer adapts an esutils.BulkIndexer to the bulkIndexer interface for a single index
+type esBulkIndexer struct {
+	*esutils.BulkIndexer
+	index string
+}
+
+func (b esBulkIndexer) Index(id, doc string) error {
+	return b.Add(elastic.NewBulkIndexRequest().Index(b.index).Id(id).Doc(doc))
+}
+
+func (b esBulkIndexer) Delete(id string) error {
+	return b.Add(elastic.NewBulkDeleteRequest().Index(b.index).Id(id))
+}
+
+// Index returns the name of the index this connection reads and writes
+func (es *ESConnection) Index() string {
+	return es.index
+}
+
+// SearchAll pages through every hit for query using a point in time and search_after, so results
+// aren't limited by the ES result window. Only the given source fields are fetched. Each page is
+// passed to fn along with the total number of hits; if fn returns an error, paging stops and it's returned.
+func (es *ESConnection) SearchAll(ctx context.Context, query searchQuery, fields []string, fn func(total int64, hits []searchHit) error) error {
+	q, err := json.Marshal(query)
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode query")
+	}
+
+	pit, err := es.es.OpenPointInTime(es.index).KeepAlive(pitKeepAlive).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Unable to open point in time")
+	}
+	pitID := pit.Id
+	defer func() {
+		// the caller's context may be done by now, and the point in time should be closed regardless
+		if _, err := es.es.ClosePointInTime(pitID).Do(context.Background()); err != nil {
+			log.Debugf("Failed closing point in time: %s", err)
+		}
+	}()
+
+	var after []interface{}
+	for {
+		search := es.es.Search().
+			PointInTime(elastic.NewPointInTimeWithKeepAlive(pitID, pitKeepAlive)).
+			Query(elastic.NewRawStringQuery(string(q))).
+			Sort("id", true).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include(fields...)).
+			TrackTotalHits(true).
+			Size(searchPageSize)
+		if after != nil {
+			search = search.SearchAfter(after...)
+		}
+
+		res, err := search.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if res.PitId != "" {
+			pitID = res.PitId
+		}
+
+		hits := res.Hits.Hits
+		if len(hits) == 0 {
+			return nil
+		}
+		page := make([]searchHit, len(hits))
+		for i, hit := range hits {
+			page[i] = searchHit{ID: hit.Id, Source: hit.Source}
+		}
+		if err = fn(res.TotalHits(), page); err != nil {
+			return err
+		}
+		if len(hits) < searchPageSize {
+			return nil
+		}
+		after = hits[len(hits)-1].Sort
+	}
+}
+
+// NewBulkIndexer returns an esutils.BulkIndexer for this connection's index given a size
+func (es *ESConnection) NewBulkIndexer(context context.Context, bulkSize int) bulkIndexer {
+	return esBulkIndexer{esutils.NewBulkIndexerContext(context, es.es, bulkSize), es.index}
+}
+
+// Ping checks that the cluster is reachable and not reporting red status
+func (es *ESConnection) Ping(ctx context.Context) error {
+	health, err := es.es.ClusterHealth().Do(ctx)
+	if err != nil {
+		return err
+	}
+	if health.Status == "red" {
+		return errors.Errorf("Cluster %s reports red status", health.ClusterName)
+	}
+	return nil
+}
+
+// WithIndex returns a connection sharing the same client which reads and writes the given index instead
+func (es *ESConnection) WithIndex(index string) SearchBackend {
+	return &ESConnection{es: es.es, index: index}
+}
+
+// CreateIndex creates a new index with the bundled settings and mappings
+func (es *ESConnection) CreateIndex(ctx context.Context, index string) error {
+	res, err := es.es.CreateIndex(index).BodyString(dataIndexBody).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !res.Acknowledged {
+		return errors.Errorf("Creating index %s was not acknowledged", index)
+	}
+	return nil
+}
+
+// CountDocuments refreshes the given index and returns how many documents of the given types it holds
+func (es *ESConnection) CountDocuments(ctx context.Context, index string, docTypes ...string) (int64, error) {
+	if _, err := es.es.Refresh(index).Do(ctx); err != nil {
+		return 0, err
+	}
+
+	types := make([]interface{}, len(docTypes))
+	for i, t := range docTypes {
+		types[i] = t
+	}
+	return es.es.Count(index).Query(elastic.NewTermsQuery("doc_type", types...)).Do(ctx)
+}
+
+// AliasedIndices returns the indices behind the given alias. If name is a concrete index rather
+// than an alias, it's returned with isIndex set. Nothing is returned if it doesn't exist at all.
+func (es *ESConnection) AliasedIndices(ctx context.Context, name string) (indices []string, isIndex bool, err error) {
+	res, err := es.es.Aliases().Index(name).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if _, ok := res.Indices[name]; ok {
+		return []string{name}, true, nil
+	}
+	return res.IndicesByAlias(name), false, nil
+}
+
+// SwapAlias atomically points alias at index instead of the old indices. If the alias name is
+// currently taken by a concrete index, that index is deleted in the same operation.
+func (es *ESConnection) SwapAlias(ctx context.Context, alias, index string, old []string, replaceIndex bool) error {
+	var actions []elastic.AliasAction
+	if replaceIndex {
+		actions = append(actions, elastic.NewAliasRemoveIndexAction(alias))
+	} else if len(old) > 0 {
+		actions = append(actions, elastic.NewAliasRemoveAction(alias).Index(old...))
+	}
+	actions = append(actions, elastic.NewAliasAddAction(alias).Index(index))
+
+	res, err := es.es.Alias().Action(actions...).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !res.Acknowledged {
+		return errors.Errorf("Pointing alias %s at %s was not acknowledged", alias, index)
+	}
+	return nil
+}
+
+// DeleteIndices deletes the given indices
+func (es *ESConnection) DeleteIndices(ctx context.Context, indices ...string) error {
+	_, err := es.es.DeleteIndex(indices...).Do(ctx)
+	return err
+}
+
+// GetMappings returns the mappings of each of the given indices, keyed by index name
+func (es *ESConnection) GetMappings(ctx context.Context, indices ...string) (map[string]map[string]interface{}, error) {
+	res, err := es.es.GetMapping().Index(indices...).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[string]map[string]interface{})
+	for index, v := range res {
+		entry, _ := v.(map[string]interface{})
+		m, _ := entry["mappings"].(map[string]interface{})
+		mappings[index] = m
+	}
+	return mappings, nil
+}
+
+// GetAnalysis returns the analysis settings of each of the given indices, keyed by index name
+func (es *ESConnection) GetAnalysis(ctx context.Context, indices ...string) (map[string]map[string]interface{}, error) {
+	res, err := es.es.IndexGetSettings(indices...).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	analysis := make(map[string]map[string]interface{})
+	for index, v := range res {
+		settings, _ := v.Settings["index"].(map[string]interface{})
+		a, _ := settings["analysis"].(map[string]interface{})
+		analysis[index] = a
+	}
+	return analysis, nil
 }
 
 // Close stops the underlying elastic.Client
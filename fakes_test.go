@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeObjects is an in-memory objectSource holding file and folder documents by ID
+type fakeObjects map[string]ElasticsearchDocument
+
+func (f fakeObjects) SelectPrefix(ctx context.Context, log *logrus.Entry, prefix string) (objectSelection, int64, error) {
+	sel := fakeSelection{}
+	for id, doc := range f {
+		if strings.HasPrefix(id, strings.ToLower(prefix)) {
+			sel[id] = doc
+		}
+	}
+	return sel, int64(len(sel)), nil
+}
+
+// fakeSelection is the objectSelection returned by fakeObjects
+type fakeSelection map[string]ElasticsearchDocument
+
+func (s fakeSelection) Prepare(ctx context.Context, log *logrus.Entry) error { return nil }
+func (s fakeSelection) Close()                                               {}
+
+func (s fakeSelection) DataObjects(ctx context.Context, irodsZone string) (objectRows, error) {
+	return s.rows("file")
+}
+
+func (s fakeSelection) Collections(ctx context.Context, irodsZone string) (objectRows, error) {
+	return s.rows("folder")
+}
+
+func (s fakeSelection) rows(docType string) (objectRows, error) {
+	rows := &fakeRows{}
+	for id, doc := range s {
+		if doc.DocType != docType {
+			continue
+		}
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		rows.rows = append(rows.rows, [2]string{id, string(b)})
+	}
+	sort.Slice(rows.rows, func(i, j int) bool { return rows.rows[i][0] < rows.rows[j][0] })
+	return rows, nil
+}
+
+// fakeRows iterates over (id, JSON) pairs like the *sql.Rows from the ICAT
+type fakeRows struct {
+	rows [][2]string
+	next int
+}
+
+func (r *fakeRows) Next() bool {
+	r.next++
+	return r.next <= len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	if len(dest) != 2 {
+		return errors.Errorf("Expected 2 scan destinations, got %d", len(dest))
+	}
+	for i, d := range dest {
+		s, ok := d.(*string)
+		if !ok {
+			return errors.Errorf("Expected *string scan destination, got %T", d)
+		}
+		*s = r.rows[r.next-1][i]
+	}
+	return nil
+}
+
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Err() error   { return nil }
+
+// fakeMetadata is an in-memory metadataSource
+type fakeMetadata struct {
+	// avus maps file and folder UUIDs to their CyVerse metadata
+	avus map[string][]Metadatum
+
+	tags []ElasticsearchTag
+}
+
+func (f fakeMetadata) PrefixAVUs(ctx context.Context, prefix string) (map[string]string, error) {
+	avus := make(map[string]string)
+	for id, md := range f.avus {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		b, err := json.Marshal(CyverseMetadata{Cyverse: md})
+		if err != nil {
+			return nil, err
+		}
+		avus[id] = string(b)
+	}
+	return avus, nil
+}
+
+func (f fakeMetadata) TagRows(ctx context.Context, irodsZone string) ([]tagRow, error) {
+	var rows []tagRow
+	for _, tag := range f.tags {
+		b, err := json.Marshal(tag)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, tagRow{id: tag.ID, json: string(b)})
+	}
+	return rows, nil
+}
+
+// fakeSearch is an in-memory searchSink. It understands the subset of the query DSL used while reindexing.
+type fakeSearch struct {
+	docs map[string]json.RawMessage
+
+	// writes counts the index and delete requests flushed to it
+	writes int
+}
+
+func newFakeSearch(docs ...interface{}) (*fakeSearch, error) {
+	f := &fakeSearch{docs: make(map[string]json.RawMessage)}
+	for _, doc := range docs {
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		var id struct {
+			ID string `json:"id"`
+		}
+		if err = json.Unmarshal(b, &id); err != nil {
+			return nil, err
+		}
+		f.docs[id.ID] = b
+	}
+	return f, nil
+}
+
+func (f *fakeSearch) SearchAll(ctx context.Context, query searchQuery, fields []string, fn func(total int64, hits []searchHit) error) error {
+	var hits []searchHit
+	for id, source := range f.docs {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(source, &doc); err != nil {
+			return err
+		}
+		ok, err := queryMatches(query, id, doc)
+		if err != nil {
+			return err
+		}
+		if ok {
+			hits = append(hits, searchHit{ID: id, Source: source})
+		}
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].ID < hits[j].ID })
+	return fn(int64(len(hits)), hits)
+}
+
+func (f *fakeSearch) NewBulkIndexer(ctx context.Context, bulkSize int) bulkIndexer {
+	return &fakeBulkIndexer{search: f}
+}
+
+// queryClauses returns the queries in a bool query clause, which may be a single query or a list of them
+func queryClauses(v interface{}) []map[string]interface{} {
+	switch c := v.(type) {
+	case searchQuery:
+		return []map[string]interface{}{c}
+	case map[string]interface{}:
+		return []map[string]interface{}{c}
+	case []interface{}:
+		var clauses []map[string]interface{}
+		for _, q := range c {
+			clauses = append(clauses, queryClauses(q)...)
+		}
+		return clauses
+	}
+	return nil
+}
+
+// stringValues returns a list of strings from a query, whether it was built in Go or decoded from JSON
+func stringValues(v interface{}) []string {
+	switch l := v.(type) {
+	case []string:
+		return l
+	case []interface{}:
+		values := make([]string, len(l))
+		for i, s := range l {
+			values[i] = fmt.Sprint(s)
+		}
+		return values
+	}
+	return nil
+}
+
+// queryMatches evaluates the bool, term, terms, prefix and ids queries against a document
+func queryMatches(query map[string]interface{}, id string, doc map[string]interface{}) (bool, error) {
+	for kind, body := range query {
+		var ok bool
+		switch kind {
+		case "bool":
+			b := body.(map[string]interface{})
+			ok = true
+			for _, c := range append(queryClauses(b["must"]), queryClauses(b["filter"])...) {
+				m, err := queryMatches(c, id, doc)
+				if err != nil {
+					return false, err
+				}
+				ok = ok && m
+			}
+			should := queryClauses(b["should"])
+			var min int
+			switch m := b["minimum_should_match"].(type) {
+			case int:
+				min = m
+			case float64:
+				min = int(m)
+			}
+			if _, set := b["minimum_should_match"]; !set && b["must"] == nil && b["filter"] == nil && len(should) > 0 {
+				min = 1
+			}
+			matched := 0
+			for _, c := range should {
+				m, err := queryMatches(c, id, doc)
+				if err != nil {
+					return false, err
+				}
+				if m {
+					matched++
+				}
+			}
+			ok = ok && matched >= min
+		case "term":
+			for field, value := range body.(map[string]interface{}) {
+				ok = doc[field] == value
+			}
+		case "terms":
+			for field, values := range body.(map[string]interface{}) {
+				for _, v := range stringValues(values) {
+					ok = ok || doc[field] == v
+				}
+			}
+		case "prefix":
+			for field, value := range body.(map[string]interface{}) {
+				ok = strings.HasPrefix(fmt.Sprint(doc[field]), value.(string))
+			}
+		case "ids":
+			for _, v := range stringValues(body.(map[string]interface{})["values"]) {
+				ok = ok || id == v
+			}
+		default:
+			return false, errors.Errorf("Unsupported query %s", kind)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fakeBulkIndexer applies requests to a fakeSearch when flushed
+type fakeBulkIndexer struct {
+	search  *fakeSearch
+	pending []func()
+}
+
+func (b *fakeBulkIndexer) Index(id, doc string) error {
+	b.pending = append(b.pending, func() { b.search.docs[id] = json.RawMessage(doc) })
+	return nil
+}
+
+func (b *fakeBulkIndexer) Delete(id string) error {
+	b.pending = append(b.pending, func() { delete(b.search.docs, id) })
+	return nil
+}
+
+func (b *fakeBulkIndexer) CanFlush() bool { return len(b.pending) > 0 }
+
+func (b *fakeBulkIndexer) Flush() error {
+	for _, apply := range b.pending {
+		apply()
+	}
+	b.search.writes += len(b.pending)
+	b.pending = nil
+	return nil
+}
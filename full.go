@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fullReindexer reindexes tags and every prefix in turn, as in full mode
+type fullReindexer struct {
+	icat       *ICATConnection
+	dedb       *DEDBConnection
+	es         SearchBackend
+	ledger     *runLedger
+	checkpoint *checkpoint
+	opts       ReindexOptions
+
+	// workers is how many prefixes to reindex at once
+	workers int
+}
+
+// tryReindexPrefix reindexes a prefix, splitting it as many times as needed, skipping anything already checkpointed
+func (f *fullReindexer) tryReindexPrefix(context context.Context, prefix string) error {
+	if f.checkpoint.Done(prefix) {
+		log.Debugf("Prefix %s already completed, skipping", prefix)
+		return nil
+	}
+
+	start := time.Now()
+	rows, err := ReindexPrefix(context, f.icat, f.dedb, f.es, prefix, irodsZone, f.opts)
+	f.ledger.recordPrefix(context, f.opts.RunID, prefix, newLedgerEntry(rows, time.Since(start), err))
+	if err == ErrTooManyResults {
+		prefixSplitsTotal.Inc()
+		for _, newprefix := range splitPrefix(prefix) {
+			err = f.tryReindexPrefix(context, newprefix)
+			if err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// startRun records the run in the ledger, reusing the run being resumed if there is one
+func (f *fullReindexer) startRun(ctx context.Context) {
+	if f.ledger == nil {
+		return
+	}
+
+	f.opts.RunID = f.checkpoint.RunID()
+	if f.opts.RunID != "" {
+		log.Infof("Resuming run %s", f.opts.RunID)
+		return
+	}
+
+	f.opts.RunID = newRunID()
+	log.Infof("Starting run %s", f.opts.RunID)
+	err := f.ledger.StartRun(ctx, f.opts.RunID, f.opts.DryRun)
+	if err == nil {
+		err = f.ledger.QueuePrefixes(ctx, f.opts.RunID, generatePrefixes(basePrefixLength))
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed recording run %s", f.opts.RunID))
+	}
+}
+
+// run reindexes tags and then every prefix, using the configured number of workers. A failed prefix
+// doesn't stop the others; all failures are returned together. Once stop is closed no more prefixes
+// are started. Anything the checkpoint has already completed is skipped.
+func (f *fullReindexer) run(ctx context.Context, stop <-chan struct{}) error {
+	f.startRun(ctx)
+
+	if !f.checkpoint.Done(tagsCheckpoint) {
+		start := time.Now()
+		if err := ReindexTags(ctx, f.dedb, tagTargetSource(f.icat), f.es, irodsZone, f.opts); err != nil {
+			return errors.Wrap(err, "Full indexing (tags) failed")
+		}
+		f.ledger.recordPrefix(ctx, f.opts.RunID, tagsCheckpoint, ledgerEntry{Status: prefixCompleted, Duration: time.Since(start)})
+	}
+
+	return f.reindexPrefixes(ctx, generatePrefixes(basePrefixLength), stop)
+}
+
+// reindexPrefixes hands the prefixes out to a pool of workers and waits for them to finish
+func (f *fullReindexer) reindexPrefixes(ctx context.Context, prefixes []string, stop <-chan struct{}) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	workers := max(f.workers, 1)
+	log.Infof("Reindexing %d prefixes with %d workers", len(prefixes), workers)
+
+	work := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for prefix := range work {
+				log.Infof("Reindexing prefix %s", prefix)
+				if err := f.tryReindexPrefix(ctx, prefix); err != nil {
+					log.Errorf("Error reindexing prefix %s: %s", prefix, err)
+					mu.Lock()
+					errs = append(errs, errors.Wrapf(err, "prefix %s", prefix))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	stopped := false
+dispatch:
+	for _, prefix := range prefixes {
+		select {
+		case work <- prefix:
+		case <-stop:
+			log.Info("Stopping, waiting for in-progress prefixes to finish")
+			stopped = true
+			break dispatch
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errors.Wrapf(stderrors.Join(errs...), "Full reindexing failed for %d prefixes", len(errs))
+	}
+	if stopped {
+		return errors.New("Full reindexing stopped before completion, use --resume to continue")
+	}
+	return nil
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"database/sql"
 
 	"github.com/cyverse-de/dbutil"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // ICATConnection wraps a sql.DB for the ICAT
@@ -22,8 +23,8 @@ type ICATTx struct {
 	tx *sql.Tx
 }
 
-// SetupICAT initializes an ICATConnection for the given dbURI
-func SetupICAT(dbURI string) (*ICATConnection, error) {
+// SetupICAT initializes an ICATConnection for the given dbURI, allowing up to maxConns open connections
+func SetupICAT(dbURI string, maxConns int) (*ICATConnection, error) {
 	connector, err := dbutil.NewDefaultConnector("1m")
 	if err != nil {
 		return nil, err
@@ -41,12 +42,22 @@ func SetupICAT(dbURI string) (*ICATConnection, error) {
 	}
 	log.Info("Successfully pinged the database")
 
-	db.SetMaxOpenConns(10)
+	db.SetMaxOpenConns(maxConns)
 	db.SetConnMaxIdleTime(time.Minute)
 
 	return &ICATConnection{db: db}, nil
 }
 
+// Close closes the underlying sql.DB
+func (d *ICATConnection) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database is still reachable
+func (d *ICATConnection) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 // BeginTx starts an ICATTx for the given ICATConnection
 func (d *ICATConnection) BeginTx(ctx context.Context, opts *sql.TxOptions) (*ICATTx, error) {
 	tx, err := d.db.BeginTx(ctx, opts)
@@ -61,6 +72,10 @@ func (d *ICATConnection) BeginTx(ctx context.Context, opts *sql.TxOptions) (*ICA
 
 // CreateTemporaryTable creates a temporary table set to ON COMMIT DROP for the given name and query on the given ICATTx
 func (tx *ICATTx) CreateTemporaryTable(ctx context.Context, name string, query string, args ...interface{}) (int64, error) {
+	if err := checkTemporaryTables(name); err != nil {
+		return 0, err
+	}
+
 	res, err := tx.tx.ExecContext(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE %s ON COMMIT DROP AS %s", name, query), args...)
 	if err != nil {
 		return 0, err
@@ -78,8 +93,12 @@ func (tx *ICATTx) CreateTemporaryTable(ctx context.Context, name string, query s
 	return rowsAffected, nil
 }
 
-// GetDataObjects returns a sql.Rows for data objects using the temporary tables which should already be set up
-func (tx *ICATTx) GetDataObjects(ctx context.Context, uuidTable string, permsTable string, metaTable string, folderBase string) (*sql.Rows, error) {
+// GetDataObjects returns a sql.Rows for data objects in the given zone using the temporary tables which should already be set up
+func (tx *ICATTx) GetDataObjects(ctx context.Context, uuidTable string, permsTable string, metaTable string, irodsZone string) (*sql.Rows, error) {
+	if err := checkTemporaryTables(uuidTable, permsTable, metaTable); err != nil {
+		return nil, err
+	}
+
 	query := fmt.Sprintf(`SELECT id, to_json(q.*) FROM (
 SELECT ou.id "id",
        'file' "doc_type",
@@ -97,13 +116,17 @@ SELECT ou.id "id",
   JOIN %[1]s ou on d1.data_id = ou.object_id
   LEFT JOIN %[2]s op USING (object_id)
   LEFT JOIN %[3]s om USING (object_id)
- WHERE c.coll_name LIKE '/%[4]s/%%' AND d1.data_repl_num = (SELECT min(d2.data_repl_num) FROM r_data_main d2 WHERE d2.data_id = d1.data_id)) q ORDER BY id`, uuidTable, permsTable, metaTable, folderBase)
+ WHERE c.coll_name LIKE '/' || $1 || '/%%' AND d1.data_repl_num = (SELECT min(d2.data_repl_num) FROM r_data_main d2 WHERE d2.data_id = d1.data_id)) q ORDER BY id`, uuidTable, permsTable, metaTable)
 
-	return tx.tx.QueryContext(ctx, query)
+	return tx.tx.QueryContext(ctx, query, likeEscaper.Replace(irodsZone))
 }
 
-// GetCollections returns a sql.Rows for collections using the temporary tables which should already be set up
-func (tx *ICATTx) GetCollections(ctx context.Context, uuidTable string, permsTable string, metaTable string, folderBase string) (*sql.Rows, error) {
+// GetCollections returns a sql.Rows for collections in the given zone using the temporary tables which should already be set up
+func (tx *ICATTx) GetCollections(ctx context.Context, uuidTable string, permsTable string, metaTable string, irodsZone string) (*sql.Rows, error) {
+	if err := checkTemporaryTables(uuidTable, permsTable, metaTable); err != nil {
+		return nil, err
+	}
+
 	query := fmt.Sprintf(`SELECT id, to_json(q.*) FROM (
 SELECT ou.id "id",
        'folder' "doc_type",
@@ -120,7 +143,75 @@ SELECT ou.id "id",
   JOIN %[1]s ou on coll_id = ou.object_id
   LEFT JOIN %[2]s op USING (object_id)
   LEFT JOIN %[3]s om USING (object_id)
- WHERE coll_name LIKE '/%[4]s/%%' and coll_type = '') q ORDER BY id`, uuidTable, permsTable, metaTable, folderBase)
+ WHERE coll_name LIKE '/' || $1 || '/%%' and coll_type = '') q ORDER BY id`, uuidTable, permsTable, metaTable)
 
-	return tx.tx.QueryContext(ctx, query)
+	return tx.tx.QueryContext(ctx, query, likeEscaper.Replace(irodsZone))
+}
+
+// GetObjectIDs returns the UUIDs present in the given temporary UUID table, which should already be set up
+func (tx *ICATTx) GetObjectIDs(ctx context.Context, uuidTable string) ([]string, error) {
+	if err := checkTemporaryTables(uuidTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.tx.QueryContext(ctx, fmt.Sprintf("SELECT DISTINCT id FROM %s ORDER BY id", uuidTable))
+	if err != nil {
+		return nil, err
+	}
+	defer logIfErr(rows.Close, "closing object ID rows")
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// CountObjects returns how many distinct UUIDs belong to the data objects and collections in the given zone, which is how many file and folder documents a full reindex should produce
+func (d *ICATConnection) CountObjects(ctx context.Context, zone string) (int64, error) {
+	var count int64
+	err := d.db.QueryRowContext(ctx, `SELECT count(DISTINCT lower(meta.meta_attr_value))
+  FROM r_meta_main meta
+  JOIN r_objt_metamap map ON map.meta_id = meta.meta_id
+ WHERE meta.meta_attr_name = 'ipc_UUID'
+   AND map.object_id IN (SELECT d.data_id FROM r_data_main d JOIN r_coll_main c USING (coll_id) WHERE c.coll_name LIKE '/' || $1 || '/%'
+                         UNION SELECT coll_id FROM r_coll_main WHERE coll_name LIKE '/' || $1 || '/%' AND coll_type = '')`, likeEscaper.Replace(zone)).Scan(&count)
+	return count, err
+}
+
+// uuidCaseVariants returns each of the given lowercase UUIDs in lower and upper case. Comparing these to
+// meta_attr_value directly, rather than comparing its lowercased value, lets the ICAT use its index.
+func uuidCaseVariants(ids []string) []string {
+	variants := make([]string, 0, 2*len(ids))
+	for _, id := range ids {
+		variants = append(variants, id, strings.ToUpper(id))
+	}
+	return variants
+}
+
+// ExistingUUIDs returns which of the given lowercase UUIDs still belong to a data object or collection
+func (d *ICATConnection) ExistingUUIDs(ctx context.Context, ids []string) (map[string]bool, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT DISTINCT lower(meta.meta_attr_value)
+  FROM r_meta_main meta
+  JOIN r_objt_metamap map ON map.meta_id = meta.meta_id
+ WHERE meta.meta_attr_name = 'ipc_UUID'
+   AND meta.meta_attr_value = ANY($1)`, pq.Array(uuidCaseVariants(ids)))
+	if err != nil {
+		return nil, err
+	}
+	defer logIfErr(rows.Close, "closing existing UUID rows")
+
+	existing := make(map[string]bool, len(ids))
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+	return existing, rows.Err()
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// identifierPattern matches the plain lowercase SQL identifiers that may be formatted into queries. Anything
+// else, including quoted identifiers, is refused rather than escaped.
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// temporaryTables are the only temporary tables queries may be built with
+var temporaryTables = map[string]bool{
+	"base_object_uuids": true,
+	"object_uuids":      true,
+	"object_perms":      true,
+	"object_metadata":   true,
+}
+
+// checkSchema returns an error unless schema is a plain lowercase identifier
+func checkSchema(schema string) error {
+	if !identifierPattern.MatchString(schema) {
+		return errors.Errorf("Invalid schema name %q", schema)
+	}
+	return nil
+}
+
+// checkTemporaryTables returns an error unless every name is one of the known temporary tables
+func checkTemporaryTables(names ...string) error {
+	for _, name := range names {
+		if !temporaryTables[name] {
+			return errors.Errorf("Unknown temporary table %q", name)
+		}
+	}
+	return nil
+}
+
+// isHexPrefix returns true if the given string is a non-empty run of hexadecimal digits
+func isHexPrefix(prefix string) bool {
+	if prefix == "" {
+		return false
+	}
+	for _, c := range prefix {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestCheckSchema(t *testing.T) {
+	cases := []struct {
+		schema string
+		err    bool
+	}{
+		{"public", false},
+		{"de_2", false},
+		{"_private", false},
+		{"", true},
+		{"2de", true},
+		{"Public", true},
+		{"public.tags", true},
+		{`"public"`, true},
+		{"public; DROP TABLE tags", true},
+	}
+
+	for _, c := range cases {
+		if err := checkSchema(c.schema); (err != nil) != c.err {
+			t.Errorf("%q: got error %v, expected error: %t", c.schema, err, c.err)
+		}
+	}
+}
+
+func TestCheckTemporaryTables(t *testing.T) {
+	if err := checkTemporaryTables("object_uuids", "object_perms", "object_metadata"); err != nil {
+		t.Error(err)
+	}
+	if err := checkTemporaryTables("object_uuids", "r_data_main"); err == nil {
+		t.Error("Expected an error for a table which isn't temporary")
+	}
+}
+
+func TestIsHexPrefix(t *testing.T) {
+	cases := []struct {
+		prefix   string
+		expected bool
+	}{
+		{"0", true},
+		{"00af", true},
+		{"00AF", true},
+		{"", false},
+		{"0g", false},
+		{"00/", false},
+		{"0'; --", false},
+	}
+
+	for _, c := range cases {
+		if got := isHexPrefix(c.prefix); got != c.expected {
+			t.Errorf("%q: got %t, expected %t", c.prefix, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+)
+
+// highWaterMarkName identifies the incremental reindex's row in the infosquito_high_water_marks table
+const highWaterMarkName = "incremental"
+
+// icatTimestamp formats a time the way the ICAT stores create_ts and modify_ts, so they compare correctly as strings
+func icatTimestamp(t time.Time) string {
+	return fmt.Sprintf("%011d", t.Unix())
+}
+
+// modifyTsTables are the ICAT tables incremental reindexes filter on modify_ts, which schema/icat_modify_ts.sql indexes
+var modifyTsTables = []string{"r_data_main", "r_coll_main", "r_objt_access", "r_objt_metamap", "r_meta_main"}
+
+// checkModifyTsIndexes returns an error naming any of modifyTsTables without an index on modify_ts, since
+// incremental reindexes scan those tables in full without one
+func (d *ICATConnection) checkModifyTsIndexes(ctx context.Context) error {
+	rows, err := d.db.QueryContext(ctx, `SELECT DISTINCT tablename FROM pg_indexes
+ WHERE tablename = ANY($1) AND indexdef LIKE '%(modify_ts)'`, pq.Array(modifyTsTables))
+	if err != nil {
+		return err
+	}
+	defer logIfErr(rows.Close, "closing index rows")
+
+	indexed := make(map[string]bool)
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return err
+		}
+		indexed[table] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, table := range modifyTsTables {
+		if !indexed[table] {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("%s have no index on modify_ts, apply schema/icat_modify_ts.sql to the ICAT", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// createSinceBaseUuidsTable selects the objects modified since the given time, along with extraIDs. Renaming or
+// moving a collection only changes the collection's own modify_ts, so everything beneath a modified collection
+// is selected too, to pick up its new path.
+func createSinceBaseUuidsTable(context context.Context, log *logrus.Entry, since time.Time, extraIDs []string, tx *ICATTx) (int64, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "createSinceBaseUuidsTable")
+	defer span.End()
+
+	r, err := tx.CreateTemporaryTable(ctx, "base_object_uuids", `WITH changed_colls AS (
+SELECT coll_id, replace(replace(replace(coll_name, '\', '\\'), '%', '\%'), '_', '\_') || '/%' AS descendants
+  FROM r_coll_main
+ WHERE modify_ts >= $1
+), subtree AS (
+SELECT coll_id FROM changed_colls
+UNION SELECT sub.coll_id FROM changed_colls c JOIN r_coll_main sub ON sub.coll_name LIKE c.descendants
+)
+SELECT DISTINCT meta.meta_id, lower(meta.meta_attr_value) as id
+  FROM r_meta_main meta
+  JOIN r_objt_metamap map ON map.meta_id = meta.meta_id
+ WHERE meta.meta_attr_name = 'ipc_UUID'
+   AND (map.object_id IN (SELECT data_id FROM r_data_main WHERE modify_ts >= $1
+                          UNION SELECT coll_id FROM subtree
+                          UNION SELECT data_id FROM r_data_main WHERE coll_id IN (SELECT coll_id FROM subtree)
+                          UNION SELECT object_id FROM r_objt_access WHERE modify_ts >= $1
+                          UNION SELECT object_id FROM r_objt_metamap WHERE modify_ts >= $1
+                          UNION SELECT m.object_id FROM r_objt_metamap m JOIN r_meta_main mm ON m.meta_id = mm.meta_id WHERE mm.modify_ts >= $1)
+        OR meta.meta_attr_value = ANY($2))`, icatTimestamp(since), pq.Array(uuidCaseVariants(extraIDs)))
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("Got %d rows modified since %s", r, since)
+	return r, nil
+}
+
+// ReindexSince reindexes the data objects and collections that were modified in the ICAT, or whose CyVerse metadata was modified in the DE database, at or after the given time.
+// Everything beneath a modified collection is included, since renaming or moving a collection changes the paths beneath it without touching their modify_ts.
+// Objects deleted from the ICAT leave nothing behind to find, so they are left for the next prefix reindex to remove.
+// The ICAT needs the indexes in schema/icat_modify_ts.sql, or each call scans its largest tables in full.
+func ReindexSince(context context.Context, icat *ICATConnection, dedb *DEDBConnection, es SearchBackend, since time.Time, irodsZone string, opts ReindexOptions) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "ReindexSince")
+	defer span.End()
+
+	sincelog := log.WithFields(logrus.Fields{
+		"since": since.UTC().Format(time.RFC3339),
+	})
+	sincelog.Debugf("Indexing objects modified since %s", since)
+
+	deTx, err := dedb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	avuIDs, err := deTx.GetAVUTargetsModifiedSince(ctx, since)
+	rbErr := deTx.tx.Rollback()
+	if err != nil {
+		return errors.Wrap(err, "Error fetching modified AVU targets")
+	}
+	if rbErr != nil {
+		sincelog.Debugf("Failed rolling back DE transaction: %s", rbErr.Error())
+	}
+	sincelog.Debugf("Got %d objects with modified metadata", len(avuIDs))
+
+	return reindexSelected(ctx, sincelog, icat, dedb, es, sinceUuids(since, avuIDs), nil, irodsZone, "since", since.UTC().Format(time.RFC3339), opts)
+}
+
+func sinceUuids(since time.Time, extraIDs []string) baseUuidsCreator {
+	return func(ctx context.Context, log *logrus.Entry, tx *ICATTx) (int64, error) {
+		return createSinceBaseUuidsTable(ctx, log, since, extraIDs, tx)
+	}
+}
+
+// loadHighWaterMark reads the time of the last successful incremental reindex from the DE database.
+// If there isn't one yet, it returns the current time less the given lookback.
+func (d *DEDBConnection) loadHighWaterMark(ctx context.Context, lookback time.Duration) (time.Time, error) {
+	var mark time.Time
+	err := d.db.QueryRowContext(ctx, fmt.Sprintf("SELECT mark FROM %s.infosquito_high_water_marks WHERE name = $1", d.schema), highWaterMarkName).Scan(&mark)
+	if err == sql.ErrNoRows {
+		since := time.Now().Add(-lookback)
+		log.Warnf("No incremental high-water mark found, using %s", since)
+		return since, nil
+	} else if err != nil {
+		return time.Time{}, errors.Wrap(err, "Couldn't read the incremental high-water mark (see schema/high_water_mark.sql)")
+	}
+	return mark, nil
+}
+
+// saveHighWaterMark records the time of a successful incremental reindex in the DE database. The mark
+// never moves backwards, so a slow reindex finishing after a later one doesn't undo its progress.
+func (d *DEDBConnection) saveHighWaterMark(ctx context.Context, mark time.Time) error {
+	_, err := d.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %[1]s.infosquito_high_water_marks AS m (name, mark) VALUES ($1, $2)
+ON CONFLICT (name) DO UPDATE SET mark = greatest(m.mark, EXCLUDED.mark), updated_on = now()`, d.schema), highWaterMarkName, mark)
+	return err
+}
+
+// sinceReindexer reindexes everything modified at or after since, normally ReindexSince
+type sinceReindexer func(ctx context.Context, since time.Time, opts ReindexOptions) error
+
+// icatSince returns a sinceReindexer running ReindexSince against the given databases and search backend
+func icatSince(icat *ICATConnection, dedb *DEDBConnection, es SearchBackend) sinceReindexer {
+	return func(ctx context.Context, since time.Time, opts ReindexOptions) error {
+		return ReindexSince(ctx, icat, dedb, es, since, irodsZone, opts)
+	}
+}
+
+// reindexIncremental reindexes from the persisted high-water mark, or from the given time if it isn't zero, and advances the mark on success.
+// Dry runs never advance the mark.
+func reindexIncremental(ctx context.Context, marks highWaterMarkStore, reindex sinceReindexer, since time.Time, opts ReindexOptions) error {
+	persist := since.IsZero() && !opts.DryRun
+	if since.IsZero() {
+		var err error
+		since, err = marks.loadHighWaterMark(ctx, incrementalLookback)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Take the new mark before querying so changes made during the run are picked up next time
+	mark := time.Now()
+	if err := reindex(ctx, since, opts); err != nil {
+		return err
+	}
+
+	if persist {
+		return marks.saveHighWaterMark(ctx, mark)
+	}
+	return nil
+}
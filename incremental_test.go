@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestIcatTimestamp(t *testing.T) {
+	got := icatTimestamp(time.Unix(1700000000, 0))
+	if got != "01700000000" {
+		t.Errorf("Got %q instead of expected %q", got, "01700000000")
+	}
+}
+
+// fakeMarks is a highWaterMarkStore holding a single mark in memory
+type fakeMarks struct {
+	mark  time.Time
+	saves int
+}
+
+func (f *fakeMarks) loadHighWaterMark(ctx context.Context, lookback time.Duration) (time.Time, error) {
+	if f.mark.IsZero() {
+		return time.Now().Add(-lookback), nil
+	}
+	return f.mark, nil
+}
+
+func (f *fakeMarks) saveHighWaterMark(ctx context.Context, mark time.Time) error {
+	f.saves++
+	if mark.After(f.mark) {
+		f.mark = mark
+	}
+	return nil
+}
+
+func TestReindexIncremental(t *testing.T) {
+	stored := time.Unix(1700000000, 0)
+	explicit := time.Unix(1600000000, 0)
+
+	cases := []struct {
+		name      string
+		stored    time.Time
+		since     time.Time
+		dryRun    bool
+		failure   error
+		fromStore bool // whether the reindex should start at the stored mark
+		advances  bool // whether the mark should move to the start of the run
+	}{
+		{"advances the mark", stored, time.Time{}, false, nil, true, true},
+		{"dry run keeps the mark", stored, time.Time{}, true, nil, true, false},
+		{"explicit since keeps the mark", stored, explicit, false, nil, false, false},
+		{"failure keeps the mark", stored, time.Time{}, false, errors.New("ICAT unavailable"), true, false},
+	}
+
+	for _, c := range cases {
+		marks := &fakeMarks{mark: c.stored}
+		var got time.Time
+		var gotDryRun bool
+		reindex := func(ctx context.Context, since time.Time, opts ReindexOptions) error {
+			got, gotDryRun = since, opts.DryRun
+			return c.failure
+		}
+
+		before := time.Now()
+		err := reindexIncremental(context.Background(), marks, reindex, c.since, ReindexOptions{DryRun: c.dryRun})
+		if err != c.failure {
+			t.Errorf("%s: got error %v, expected %v", c.name, err, c.failure)
+		}
+
+		expectedSince := c.since
+		if c.fromStore {
+			expectedSince = c.stored
+		}
+		if !got.Equal(expectedSince) {
+			t.Errorf("%s: reindexed since %s, expected %s", c.name, got, expectedSince)
+		}
+		if gotDryRun != c.dryRun {
+			t.Errorf("%s: reindexed with dry run %t, expected %t", c.name, gotDryRun, c.dryRun)
+		}
+
+		if c.advances {
+			if marks.saves != 1 || marks.mark.Before(before) || marks.mark.After(time.Now()) {
+				t.Errorf("%s: got mark %s after %d saves, expected the start of the run", c.name, marks.mark, marks.saves)
+			}
+		} else if marks.saves != 0 || !marks.mark.Equal(c.stored) {
+			t.Errorf("%s: got mark %s after %d saves, expected it left at %s", c.name, marks.mark, marks.saves, c.stored)
+		}
+	}
+}
+
+func TestReindexIncrementalWithoutMark(t *testing.T) {
+	oldLookback := incrementalLookback
+	incrementalLookback = time.Hour
+	t.Cleanup(func() { incrementalLookback = oldLookback })
+
+	marks := &fakeMarks{}
+	var got time.Time
+	reindex := func(ctx context.Context, since time.Time, opts ReindexOptions) error {
+		got = since
+		return nil
+	}
+
+	before := time.Now()
+	if err := reindexIncremental(context.Background(), marks, reindex, time.Time{}, ReindexOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Before(before.Add(-time.Hour)) || got.After(time.Now().Add(-time.Hour)) {
+		t.Errorf("Reindexed since %s, expected an hour before the run", got)
+	}
+	if marks.mark.Before(before) {
+		t.Errorf("Got mark %s, expected the start of the run", marks.mark)
+	}
+}
@@ -0,0 +1,536 @@
+//go:build integration
+
+// The integration tests run the real ICAT and DE database queries against a local Postgres loaded
+// with the fixtures in testdata, indexing into an httptest stand-in for Elasticsearch. Run them with
+//
+//	go test -tags integration ./...
+//
+// An embedded Postgres is downloaded and started unless INFOSQUITO2_TEST_DB names a database to use
+// instead, which the fixtures will overwrite.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/olivere/elastic/v7"
+)
+
+// integrationPort is the port the embedded Postgres listens on
+const integrationPort = 54329
+
+// integrationDBURI is the database the fixtures were loaded into
+var integrationDBURI string
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegration(m))
+}
+
+func runIntegration(m *testing.M) int {
+	uri := os.Getenv("INFOSQUITO2_TEST_DB")
+	if uri == "" {
+		dir, err := os.MkdirTemp("", "infosquito2-postgres")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+
+		cfg := embeddedpostgres.DefaultConfig().
+			Port(integrationPort).
+			Database("infosquito2").
+			RuntimePath(dir).
+			Logger(io.Discard)
+		pg := embeddedpostgres.NewDatabase(cfg)
+		if err = pg.Start(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start embedded Postgres: %s\n", err)
+			return 1
+		}
+		defer func() {
+			if err := pg.Stop(); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to stop embedded Postgres: %s\n", err)
+			}
+		}()
+		uri = cfg.GetConnectionURL() + "?sslmode=disable"
+	}
+
+	if err := loadFixtures(uri, "icat.sql", "de.sql"); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load fixtures: %s\n", err)
+		return 1
+	}
+	if err := loadSchema(uri, "de", "run_ledger.sql", "high_water_mark.sql"); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load the infosquito2 tables: %s\n", err)
+		return 1
+	}
+	integrationDBURI = uri
+
+	return m.Run()
+}
+
+// loadFixtures runs each of the given SQL files from testdata against the database
+func loadFixtures(uri string, files ...string) error {
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join("testdata", f))
+		if err != nil {
+			return err
+		}
+		if _, err = db.Exec(string(b)); err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// loadSchema runs each of the given SQL files from schema against the database, creating their tables in the given schema
+func loadSchema(uri, schema string, files ...string) error {
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join("schema", f))
+		if err != nil {
+			return err
+		}
+		if _, err = db.Exec(fmt.Sprintf("SET search_path TO %s;\n%s", schema, b)); err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// setupDatabases connects to the fixture ICAT and DE databases
+func setupDatabases(t *testing.T) (*ICATConnection, *DEDBConnection) {
+	icat, err := SetupICAT(integrationDBURI, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { icat.Close() })
+
+	dedb, err := SetupDEDB(integrationDBURI, "de", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dedb.Close() })
+	return icat, dedb
+}
+
+// esStandIn serves the Elasticsearch APIs used while reindexing from a fakeSearch, recording each bulk request
+type esStandIn struct {
+	t *testing.T
+
+	mu     sync.Mutex
+	search *fakeSearch
+
+	// requests holds an "action id" entry for each bulk request, in the order they were sent
+	requests []string
+}
+
+// newESStandIn starts an esStandIn holding the given documents and returns a connection to it
+func newESStandIn(t *testing.T, docs ...interface{}) (*ESConnection, *esStandIn) {
+	search, err := newFakeSearch(docs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &esStandIn{t: t, search: search}
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	c, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ESConnection{es: c, index: "data"}, s
+}
+
+// takeRequests returns the bulk requests recorded so far and forgets them
+func (s *esStandIn) takeRequests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func (s *esStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/_pit"):
+		io.WriteString(w, `{"id": "stand-in"}`)
+	case r.Method == http.MethodDelete && r.URL.Path == "/_pit":
+		io.WriteString(w, `{"succeeded": true, "num_freed": 1}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/_search":
+		s.serveSearch(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+		s.serveBulk(w, r)
+	default:
+		s.t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error": "unsupported by the stand-in"}`)
+	}
+}
+
+type standInHit struct {
+	ID     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+	Sort   []interface{}   `json:"sort"`
+}
+
+// serveSearch answers a point in time search, sorted by ID and paged with search_after
+func (s *esStandIn) serveSearch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query       map[string]interface{} `json:"query"`
+		Size        int                    `json:"size"`
+		SearchAfter []interface{}          `json:"search_after"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.t.Errorf("Unable to decode search: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var total int64
+	hits := []standInHit{}
+	err := s.search.SearchAll(r.Context(), searchQuery(req.Query), nil, func(t int64, page []searchHit) error {
+		total = t
+		for _, hit := range page {
+			if len(req.SearchAfter) > 0 && hit.ID <= fmt.Sprint(req.SearchAfter[0]) {
+				continue
+			}
+			if len(hits) < req.Size {
+				hits = append(hits, standInHit{ID: hit.ID, Source: hit.Source, Sort: []interface{}{hit.ID}})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.t.Errorf("Unable to search: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pit_id": "stand-in",
+		"hits": map[string]interface{}{
+			"total": map[string]interface{}{"value": total, "relation": "eq"},
+			"hits":  hits,
+		},
+	})
+}
+
+// serveBulk applies and records the index and delete requests in a bulk body
+func (s *esStandIn) serveBulk(w http.ResponseWriter, r *http.Request) {
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	var items []map[string]interface{}
+	for scanner.Scan() {
+		var action map[string]struct {
+			ID string `json:"_id"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			s.t.Errorf("Unable to decode bulk action %s: %s", scanner.Text(), err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for kind, meta := range action {
+			switch kind {
+			case "index":
+				if !scanner.Scan() {
+					s.t.Errorf("Bulk index of %s has no document", meta.ID)
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				s.search.docs[meta.ID] = json.RawMessage(append([]byte(nil), scanner.Bytes()...))
+			case "delete":
+				delete(s.search.docs, meta.ID)
+			default:
+				s.t.Errorf("Unexpected bulk action %s", kind)
+			}
+			s.requests = append(s.requests, kind+" "+meta.ID)
+			items = append(items, map[string]interface{}{kind: map[string]interface{}{"_index": "data", "_id": meta.ID, "status": 200}})
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": false, "items": items})
+}
+
+// indexedDocument decodes a document held by the stand-in
+func (s *esStandIn) indexedDocument(t *testing.T, id string, doc interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	source, ok := s.search.docs[id]
+	if !ok {
+		t.Errorf("Document %s was not indexed", id)
+		return false
+	}
+	if err := json.Unmarshal(source, doc); err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func TestIntegrationReindexPrefix(t *testing.T) {
+	useTestSettings(t, 100)
+	icat, dedb := setupDatabases(t)
+	es, standIn := newESStandIn(t,
+		// not in the ICAT, so it should be deleted
+		fileDoc("1a000000-0000-0000-0000-000000000099", 1),
+		// outside the prefix, so it should be left alone
+		fileDoc("2b000000-0000-0000-0000-000000000099", 1),
+	)
+
+	rows, err := ReindexPrefix(context.Background(), icat, dedb, es, "1a", "iplant", ReindexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := standIn.takeRequests()
+	sort.Strings(requests)
+	expected := []string{
+		"delete 1a000000-0000-0000-0000-000000000099",
+		"index 1a000000-0000-0000-0000-000000000013",
+		"index 1a000000-0000-0000-0000-000000000020",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got bulk requests %v, expected %v", requests, expected)
+	}
+	if rows.dataobjectsAdded != 1 || rows.collsAdded != 1 || rows.dataobjectsRemoved != 1 {
+		t.Errorf("Got %d data objects and %d collections added and %d data objects removed, expected 1 of each", rows.dataobjectsAdded, rows.collsAdded, rows.dataobjectsRemoved)
+	}
+
+	expectedFile := ElasticsearchDocument{
+		DocType:      "file",
+		ID:           "1a000000-0000-0000-0000-000000000020",
+		Path:         "/iplant/home/ipcdev/a.txt",
+		Label:        "a.txt",
+		Creator:      "ipcdev#iplant",
+		FileType:     "generic",
+		DateCreated:  1600000000000,
+		DateModified: 1600000001000,
+		FileSize:     100,
+		Metadata: BothMetadata{
+			IRODS:   []Metadatum{{"color", "blue", "hue"}},
+			Cyverse: []Metadatum{{"project", "alpha", ""}, {"stage", "draft", ""}},
+		},
+		UserPermissions: []UserPermission{{"ipcdev#iplant", "own"}, {"rodsadmin#iplant", "read"}},
+	}
+	expectedFolder := ElasticsearchDocument{
+		DocType:         "folder",
+		ID:              "1a000000-0000-0000-0000-000000000013",
+		Path:            "/iplant/home/ipcdev",
+		Label:           "ipcdev",
+		Creator:         "ipcdev#iplant",
+		DateCreated:     1500000000000,
+		DateModified:    1600000000000,
+		UserPermissions: []UserPermission{{"ipcdev#iplant", "own"}},
+	}
+	for _, e := range []ElasticsearchDocument{expectedFile, expectedFolder} {
+		var doc ElasticsearchDocument
+		if standIn.indexedDocument(t, e.ID, &doc) {
+			if diff := e.Diff(doc); len(diff) > 0 {
+				t.Errorf("Document %s differs in %v: %+v", e.ID, diff, doc)
+			}
+		}
+	}
+
+	// nothing has changed, so a second pass shouldn't send anything
+	if _, err = ReindexPrefix(context.Background(), icat, dedb, es, "1a", "iplant", ReindexOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if requests = standIn.takeRequests(); len(requests) > 0 {
+		t.Errorf("Got bulk requests %v reindexing an unchanged prefix", requests)
+	}
+}
+
+func TestIntegrationReindexPath(t *testing.T) {
+	useTestSettings(t, 100)
+	icat, dedb := setupDatabases(t)
+	es, standIn := newESStandIn(t)
+
+	if err := ReindexPath(context.Background(), icat, dedb, es, "/iplant/home/ipcdev", "iplant", ReindexOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := standIn.takeRequests()
+	sort.Strings(requests)
+	expected := []string{
+		"index 1a000000-0000-0000-0000-000000000013",
+		"index 1a000000-0000-0000-0000-000000000020",
+		"index 2b000000-0000-0000-0000-000000000021",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got bulk requests %v, expected %v", requests, expected)
+	}
+
+	var doc ElasticsearchDocument
+	if standIn.indexedDocument(t, "2b000000-0000-0000-0000-000000000021", &doc) {
+		if len(doc.Metadata.Cyverse) != 1 || doc.Metadata.Cyverse[0].Value != "beta" {
+			t.Errorf("Got CyVerse metadata %v, expected project beta", doc.Metadata.Cyverse)
+		}
+	}
+}
+
+func TestIntegrationReindexSince(t *testing.T) {
+	useTestSettings(t, 100)
+	icat, dedb := setupDatabases(t)
+	es, standIn := newESStandIn(t)
+
+	if err := ReindexSince(context.Background(), icat, dedb, es, time.Unix(1700000000, 0), "iplant", ReindexOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := standIn.takeRequests()
+	sort.Strings(requests)
+	expected := []string{
+		// the fixture's AVUs were all created when it was loaded
+		"index 1a000000-0000-0000-0000-000000000020",
+		"index 2b000000-0000-0000-0000-000000000021",
+		// the renamed collection and everything beneath it, but not its lookalike
+		"index 3c000000-0000-0000-0000-000000000016",
+		"index 3c000000-0000-0000-0000-000000000017",
+		"index 3c000000-0000-0000-0000-000000000023",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got bulk requests %v, expected %v", requests, expected)
+	}
+
+	var doc ElasticsearchDocument
+	if standIn.indexedDocument(t, "3c000000-0000-0000-0000-000000000023", &doc) && doc.Path != "/iplant/home/renamed_dir/sub/d.txt" {
+		t.Errorf("Got path %q for a data object beneath the renamed collection", doc.Path)
+	}
+}
+
+func TestIntegrationReindexTags(t *testing.T) {
+	useTestSettings(t, 100)
+	_, dedb := setupDatabases(t)
+	es, standIn := newESStandIn(t)
+
+	if err := ReindexTags(context.Background(), dedb, nil, es, "iplant", ReindexOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if requests := standIn.takeRequests(); len(requests) != 2 {
+		t.Errorf("Got bulk requests %v, expected both tags to be indexed", requests)
+	}
+
+	expected := map[string]ElasticsearchTag{
+		"ff000000-0000-0000-0000-000000000001": {
+			DocType: "tag", ID: "ff000000-0000-0000-0000-000000000001", Value: "important", Description: "Things that matter",
+			Creator: "ipcdev#iplant", DateCreated: "2020-01-01T00:00:00", DateModified: "2020-01-02T00:00:00",
+			Targets: []TagTarget{{"1a000000-0000-0000-0000-000000000020", "file"}, {"1a000000-0000-0000-0000-000000000013", "folder"}},
+		},
+		"ff000000-0000-0000-0000-000000000002": {
+			DocType: "tag", ID: "ff000000-0000-0000-0000-000000000002", Value: "unused",
+			Creator: "ipcdev#iplant", DateCreated: "2020-01-01T00:00:00", DateModified: "2020-01-01T00:00:00",
+			Targets: []TagTarget{},
+		},
+	}
+	for id, e := range expected {
+		var tag ElasticsearchTag
+		if standIn.indexedDocument(t, id, &tag) {
+			if diff := e.Diff(tag); len(diff) > 0 {
+				t.Errorf("Tag %s differs in %v: %+v", id, diff, tag)
+			}
+		}
+	}
+
+	// nothing has changed, so a second pass shouldn't send anything
+	if err := ReindexTags(context.Background(), dedb, nil, es, "iplant", ReindexOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if requests := standIn.takeRequests(); len(requests) > 0 {
+		t.Errorf("Got bulk requests %v reindexing unchanged tags", requests)
+	}
+}
+
+func TestIntegrationHighWaterMark(t *testing.T) {
+	_, dedb := setupDatabases(t)
+	ctx := context.Background()
+
+	before := time.Now()
+	since, err := dedb.loadHighWaterMark(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error loading missing mark: %s", err)
+	}
+	if since.After(before.Add(-time.Hour + time.Second)) {
+		t.Errorf("Expected missing mark to fall back to the lookback, got %s", since)
+	}
+
+	mark := time.Unix(1700000000, 0)
+	if err = dedb.saveHighWaterMark(ctx, mark); err != nil {
+		t.Fatalf("Unexpected error saving mark: %s", err)
+	}
+	// an older mark saved afterwards doesn't move it backwards
+	if err = dedb.saveHighWaterMark(ctx, mark.Add(-time.Hour)); err != nil {
+		t.Fatalf("Unexpected error saving mark: %s", err)
+	}
+
+	since, err = dedb.loadHighWaterMark(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error loading mark: %s", err)
+	}
+	if !since.Equal(mark) {
+		t.Errorf("Got %s instead of expected %s", since, mark)
+	}
+}
+
+func TestIntegrationLoadCheckpoint(t *testing.T) {
+	_, dedb := setupDatabases(t)
+	ctx := context.Background()
+	ledger := setupLedger(ctx, dedb)
+	if ledger == nil {
+		t.Fatal("Expected the run ledger to be available")
+	}
+
+	runID := newRunID()
+	if err := ledger.StartRun(ctx, runID, false); err != nil {
+		t.Fatalf("Unexpected error starting run: %s", err)
+	}
+	if err := ledger.QueuePrefixes(ctx, runID, []string{"000", "001"}); err != nil {
+		t.Fatalf("Unexpected error queueing prefixes: %s", err)
+	}
+	for prefix, status := range map[string]string{tagsCheckpoint: prefixCompleted, "000": prefixCompleted} {
+		if err := ledger.RecordPrefix(ctx, runID, prefix, ledgerEntry{Status: status}); err != nil {
+			t.Fatalf("Unexpected error recording %s: %s", prefix, err)
+		}
+	}
+
+	c, err := loadCheckpoint(ctx, ledger, "")
+	if err != nil {
+		t.Fatalf("Unexpected error loading checkpoint: %s", err)
+	}
+	if c.RunID() != runID {
+		t.Errorf("Got run ID %q instead of the unfinished run %q", c.RunID(), runID)
+	}
+	if !c.Done(tagsCheckpoint) || !c.Done("000") || c.Done("001") {
+		t.Errorf("Got completed entries %v, expected tags and 000", c.done)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Prefix statuses recorded in the run ledger
+const (
+	prefixQueued    = "queued"
+	prefixCompleted = "completed"
+	prefixSplit     = "split"
+	prefixFailed    = "failed"
+)
+
+// runLedger records the progress of full reindex runs in the DE database so any replica can report on them.
+// A nil *runLedger is valid and records nothing.
+type runLedger struct {
+	db *DEDBConnection
+}
+
+// ledgerEntry is the outcome of reindexing a single prefix within a run
+type ledgerEntry struct {
+	Status   string
+	Rows     int64
+	Docs     int64
+	Added    int64
+	Updated  int64
+	Removed  int64
+	Duration time.Duration
+	Error    string
+}
+
+// runSummary is a run along with how many of its prefixes are in each status
+type runSummary struct {
+	RunID     string
+	StartedOn time.Time
+	UpdatedOn time.Time
+	DryRun    bool
+	Queued    int64
+	Completed int64
+	Split     int64
+	Failed    int64
+}
+
+// Done returns true if no prefixes in the run are still waiting to be processed
+func (r runSummary) Done() bool {
+	return r.Queued == 0 && r.Failed == 0
+}
+
+// newRunID returns an identifier for a run which sorts by start time
+func newRunID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(b))
+}
+
+// newLedgerEntry summarizes the result of reindexing a prefix
+func newLedgerEntry(rows rowMetadata, duration time.Duration, err error) ledgerEntry {
+	entry := ledgerEntry{
+		Status:   prefixCompleted,
+		Rows:     rows.rows,
+		Docs:     rows.documents,
+		Added:    rows.dataobjectsAdded + rows.collsAdded,
+		Updated:  rows.dataobjectsUpdated + rows.collsUpdated,
+		Removed:  rows.dataobjectsRemoved + rows.collsRemoved,
+		Duration: duration,
+	}
+	if err == ErrTooManyResults {
+		entry.Status = prefixSplit
+	} else if err != nil {
+		entry.Status = prefixFailed
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// ledgerTables are the tables the run ledger needs, which are created by schema/run_ledger.sql
+var ledgerTables = []string{"infosquito_runs", "infosquito_run_prefixes"}
+
+// setupLedger checks that the ledger tables exist. It returns nil, disabling the ledger, if they don't.
+// The tables live in the DE database's schema, so they're created by a migration rather than by this service.
+func setupLedger(ctx context.Context, db *DEDBConnection) *runLedger {
+	for _, table := range ledgerTables {
+		var exists bool
+		err := db.db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", fmt.Sprintf("%s.%s", db.schema, table)).Scan(&exists)
+		if err == nil && !exists {
+			err = errors.Errorf("table %s.%s does not exist, apply schema/run_ledger.sql to create it", db.schema, table)
+		}
+		if err != nil {
+			log.Errorf("Unable to set up the run ledger, progress will not be recorded: %s", err)
+			return nil
+		}
+	}
+	return &runLedger{db: db}
+}
+
+// StartRun records a new run
+func (l *runLedger) StartRun(ctx context.Context, runID string, dryRun bool) error {
+	if l == nil {
+		return nil
+	}
+	_, err := l.db.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s.infosquito_runs (run_id, dry_run) VALUES ($1, $2) ON CONFLICT DO NOTHING", l.db.schema), runID, dryRun)
+	return err
+}
+
+// QueuePrefixes records prefixes which are about to be reindexed as part of a run
+func (l *runLedger) QueuePrefixes(ctx context.Context, runID string, prefixes []string) error {
+	if l == nil {
+		return nil
+	}
+	_, err := l.db.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s.infosquito_run_prefixes (run_id, prefix, status)
+SELECT $1, p, $2 FROM unnest($3::text[]) p
+ON CONFLICT (run_id, prefix) DO UPDATE SET status = EXCLUDED.status, updated_on = now()`, l.db.schema), runID, prefixQueued, pq.Array(prefixes))
+	return err
+}
+
+// RecordPrefix records the outcome of reindexing a prefix as part of a run
+func (l *runLedger) RecordPrefix(ctx context.Context, runID, prefix string, entry ledgerEntry) error {
+	if l == nil {
+		return nil
+	}
+	var errText *string
+	if entry.Error != "" {
+		errText = &entry.Error
+	}
+	_, err := l.db.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s.infosquito_run_prefixes
+    (run_id, prefix, status, row_count, documents, added, updated, removed, duration_ms, error)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (run_id, prefix) DO UPDATE SET
+    status = EXCLUDED.status, row_count = EXCLUDED.row_count, documents = EXCLUDED.documents,
+    added = EXCLUDED.added, updated = EXCLUDED.updated, removed = EXCLUDED.removed,
+    duration_ms = EXCLUDED.duration_ms, error = EXCLUDED.error, updated_on = now()`, l.db.schema),
+		runID, prefix, entry.Status, entry.Rows, entry.Docs, entry.Added, entry.Updated, entry.Removed, entry.Duration.Milliseconds(), errText)
+	return err
+}
+
+// recordPrefix records a prefix outcome, logging rather than returning any error since the ledger is informational
+func (l *runLedger) recordPrefix(ctx context.Context, runID, prefix string, entry ledgerEntry) {
+	if runID == "" {
+		return
+	}
+	if err := l.RecordPrefix(ctx, runID, prefix, entry); err != nil {
+		log.Error(errors.Wrapf(err, "Failed recording prefix %s for run %s", prefix, runID))
+	}
+}
+
+// Runs returns summaries of the most recent runs, newest first
+func (l *runLedger) Runs(ctx context.Context, limit int) ([]runSummary, error) {
+	rows, err := l.db.db.QueryContext(ctx, fmt.Sprintf(`SELECT r.run_id, r.started_on, coalesce(max(p.updated_on), r.started_on), r.dry_run,
+       count(*) FILTER (WHERE p.status = $1),
+       count(*) FILTER (WHERE p.status = $2),
+       count(*) FILTER (WHERE p.status = $3),
+       count(*) FILTER (WHERE p.status = $4)
+  FROM %[1]s.infosquito_runs r
+  LEFT JOIN %[1]s.infosquito_run_prefixes p USING (run_id)
+ GROUP BY r.run_id, r.started_on, r.dry_run
+ ORDER BY r.started_on DESC
+ LIMIT $5`, l.db.schema), prefixQueued, prefixCompleted, prefixSplit, prefixFailed, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer logIfErr(rows.Close, "closing run ledger rows")
+
+	var runs []runSummary
+	for rows.Next() {
+		var r runSummary
+		if err = rows.Scan(&r.RunID, &r.StartedOn, &r.UpdatedOn, &r.DryRun, &r.Queued, &r.Completed, &r.Split, &r.Failed); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// Prefixes returns the ledger entries for a run, keyed by prefix and in prefix order
+func (l *runLedger) Prefixes(ctx context.Context, runID string) ([]string, map[string]ledgerEntry, error) {
+	rows, err := l.db.db.QueryContext(ctx, fmt.Sprintf(`SELECT prefix, status, row_count, documents, added, updated, removed, duration_ms, coalesce(error, '')
+  FROM %s.infosquito_run_prefixes
+ WHERE run_id = $1
+ ORDER BY prefix`, l.db.schema), runID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer logIfErr(rows.Close, "closing run ledger prefix rows")
+
+	var prefixes []string
+	entries := make(map[string]ledgerEntry)
+	for rows.Next() {
+		var prefix string
+		var e ledgerEntry
+		var ms int64
+		if err = rows.Scan(&prefix, &e.Status, &e.Rows, &e.Docs, &e.Added, &e.Updated, &e.Removed, &ms, &e.Error); err != nil {
+			return nil, nil, err
+		}
+		e.Duration = time.Duration(ms) * time.Millisecond
+		prefixes = append(prefixes, prefix)
+		entries[prefix] = e
+	}
+	return prefixes, entries, rows.Err()
+}
+
+// printRuns writes a table of recent runs
+func printRuns(w io.Writer, runs []runSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTARTED\tLAST UPDATE\tQUEUED\tCOMPLETED\tSPLIT\tFAILED\tDONE")
+	for _, r := range runs {
+		id := r.RunID
+		if r.DryRun {
+			id += " (dry run)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%t\n", id, r.StartedOn.Format(time.RFC3339), r.UpdatedOn.Format(time.RFC3339), r.Queued, r.Completed, r.Split, r.Failed, r.Done())
+	}
+	return tw.Flush()
+}
+
+// printRunPrefixes writes a table of the prefixes in a run, leaving out completed ones unless all is set
+func printRunPrefixes(w io.Writer, prefixes []string, entries map[string]ledgerEntry, all bool) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tSTATUS\tROWS\tDOCUMENTS\tADDED\tUPDATED\tREMOVED\tDURATION\tERROR")
+	for _, prefix := range prefixes {
+		e := entries[prefix]
+		if !all && (e.Status == prefixCompleted || e.Status == prefixSplit) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", prefix, e.Status, e.Rows, e.Docs, e.Added, e.Updated, e.Removed, e.Duration, e.Error)
+	}
+	return tw.Flush()
+}
+
+// showRuns prints run progress for the runs mode: a summary of recent runs, or the prefixes of a single run
+func showRuns(ctx context.Context, ledger *runLedger, w io.Writer, runID string, all bool) error {
+	if ledger == nil {
+		return errors.New("The run ledger is not available")
+	}
+
+	if runID == "" {
+		runs, err := ledger.Runs(ctx, 20)
+		if err != nil {
+			return err
+		}
+		return printRuns(w, runs)
+	}
+
+	prefixes, entries, err := ledger.Prefixes(ctx, runID)
+	if err != nil {
+		return err
+	}
+	if len(prefixes) == 0 {
+		return errors.Errorf("No prefixes recorded for run %s", runID)
+	}
+	return printRunPrefixes(w, prefixes, entries, all)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLedgerEntry(t *testing.T) {
+	rows := rowMetadata{rows: 10, documents: 8, dataobjectsAdded: 1, collsAdded: 1, dataobjectsUpdated: 3, collsRemoved: 2}
+
+	cases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"completed", nil, prefixCompleted},
+		{"split", ErrTooManyResults, prefixSplit},
+		{"failed", errors.New("boom"), prefixFailed},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			entry := newLedgerEntry(rows, time.Second, c.err)
+			if entry.Status != c.expected {
+				t.Errorf("Got status %s instead of expected %s", entry.Status, c.expected)
+			}
+			if entry.Added != 2 || entry.Updated != 3 || entry.Removed != 2 {
+				t.Errorf("Got wrong counts: %+v", entry)
+			}
+			if (c.expected == prefixFailed) != (entry.Error != "") {
+				t.Errorf("Got unexpected error text %q", entry.Error)
+			}
+		})
+	}
+}
+
+func TestPrintRunPrefixes(t *testing.T) {
+	prefixes := []string{"000", "001", "002"}
+	entries := map[string]ledgerEntry{
+		"000": {Status: prefixCompleted},
+		"001": {Status: prefixFailed, Error: "boom"},
+		"002": {Status: prefixQueued},
+	}
+
+	var buf bytes.Buffer
+	if err := printRunPrefixes(&buf, prefixes, entries, false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "000") || !strings.Contains(out, "001") || !strings.Contains(out, "002") {
+		t.Errorf("Expected only unfinished prefixes, got:\n%s", out)
+	}
+
+	buf.Reset()
+	if err := printRunPrefixes(&buf, prefixes, entries, true); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(buf.String(), "000") {
+		t.Errorf("Expected all prefixes, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dataIndexBody is the settings and mappings used to create the index, as the body of an ES create index request.
+// Bump mappings._meta.version whenever it changes, so indices built from an older version are detected as drift.
+//
+//go:embed mappings/data.json
+var dataIndexBody string
+
+// indexDefinition is the parts of the bundled index definition that are checked for drift
+type indexDefinition struct {
+	Settings struct {
+		Analysis map[string]interface{} `json:"analysis"`
+	} `json:"settings"`
+	Mappings map[string]interface{} `json:"mappings"`
+}
+
+// bundledDefinition parses the bundled index definition
+func bundledDefinition() (indexDefinition, error) {
+	var body indexDefinition
+	if err := json.Unmarshal([]byte(dataIndexBody), &body); err != nil {
+		return body, errors.Wrap(err, "Unable to parse the bundled index definition")
+	}
+	return body, nil
+}
+
+// bundledMappings returns the mappings section of the bundled index definition
+func bundledMappings() (map[string]interface{}, error) {
+	body, err := bundledDefinition()
+	if err != nil {
+		return nil, err
+	}
+	return body.Mappings, nil
+}
+
+// mappingVersion returns the version recorded in the _meta section of a mapping, or 0 if there isn't one
+func mappingVersion(mappings map[string]interface{}) int {
+	meta, _ := mappings["_meta"].(map[string]interface{})
+	version, _ := meta["version"].(float64)
+	return int(version)
+}
+
+// diffMappings returns a description of each place the actual mapping differs from the expected one, in path order
+func diffMappings(path string, expected, actual interface{}) []string {
+	expectedMap, expectedIsMap := expected.(map[string]interface{})
+	actualMap, actualIsMap := actual.(map[string]interface{})
+	if !expectedIsMap || !actualIsMap {
+		if !reflect.DeepEqual(expected, actual) {
+			return []string{fmt.Sprintf("%s: expected %v, found %v", path, expected, actual)}
+		}
+		return nil
+	}
+
+	keys := make(map[string]bool)
+	for k := range expectedMap {
+		keys[k] = true
+	}
+	for k := range actualMap {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, k := range sorted {
+		sub := k
+		if path != "" {
+			sub = path + "." + k
+		}
+		e, inExpected := expectedMap[k]
+		a, inActual := actualMap[k]
+		switch {
+		case !inActual:
+			diffs = append(diffs, fmt.Sprintf("%s: missing", sub))
+		case !inExpected:
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected", sub))
+		default:
+			diffs = append(diffs, diffMappings(sub, e, a)...)
+		}
+	}
+	return diffs
+}
+
+// setupIndex creates the configured index from the bundled definition if it doesn't exist, as an alias
+// to a new versioned index so it can later be rebuilt without downtime. If it does exist, its mappings
+// and analysis settings (the analyzers the mappings refer to) are compared against the bundled ones and
+// any drift is returned as an error.
+func setupIndex(ctx context.Context, es SearchBackend) error {
+	expected, err := bundledDefinition()
+	if err != nil {
+		return err
+	}
+	version := mappingVersion(expected.Mappings)
+
+	indices, _, err := es.AliasedIndices(ctx, es.Index())
+	if err != nil {
+		return errors.Wrapf(err, "Unable to look up %s", es.Index())
+	}
+
+	if len(indices) == 0 {
+		index := newIndexName(es.Index(), time.Now())
+		if err = es.CreateIndex(ctx, index); err != nil {
+			return errors.Wrapf(err, "Unable to create index %s", index)
+		}
+		if err = es.SwapAlias(ctx, es.Index(), index, nil, false); err != nil {
+			return errors.Wrapf(err, "Unable to point %s at %s", es.Index(), index)
+		}
+		log.Infof("Created index %s with mapping version %d, aliased as %s", index, version, es.Index())
+		return nil
+	}
+
+	mappings, err := es.GetMappings(ctx, indices...)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to get mappings for %s", es.Index())
+	}
+
+	analysis, err := es.GetAnalysis(ctx, indices...)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to get analysis settings for %s", es.Index())
+	}
+
+	var drift []string
+	for _, index := range indices {
+		for _, d := range diffMappings("", expected.Mappings, mappings[index]) {
+			drift = append(drift, fmt.Sprintf("%s %s", index, d))
+		}
+		for _, d := range diffMappings("settings.analysis", expected.Settings.Analysis, analysis[index]) {
+			drift = append(drift, fmt.Sprintf("%s %s", index, d))
+		}
+	}
+
+	if len(drift) > 0 {
+		for _, d := range drift {
+			log.Errorf("Mapping drift: %s", d)
+		}
+		return errors.Errorf("%s has drifted from mapping version %d in %d places:\n%s", es.Index(), version, len(drift), strings.Join(drift, "\n"))
+	}
+
+	log.Infof("%s matches mapping version %d", es.Index(), version)
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBundledMappings(t *testing.T) {
+	mappings, err := bundledMappings()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if mappingVersion(mappings) < 1 {
+		t.Errorf("Bundled mappings have no version")
+	}
+
+	// prefix queries depend on id being a keyword
+	props, _ := mappings["properties"].(map[string]interface{})
+	id, _ := props["id"].(map[string]interface{})
+	if id["type"] != "keyword" {
+		t.Errorf("Expected id to be a keyword, got %v", id["type"])
+	}
+}
+
+func TestDiffMappings(t *testing.T) {
+	parse := func(s string) map[string]interface{} {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatalf("Bad test mapping: %s", err)
+		}
+		return m
+	}
+
+	expected := parse(`{"_meta": {"version": 2}, "properties": {"id": {"type": "keyword"}, "fileSize": {"type": "long"}}}`)
+
+	cases := []struct {
+		name   string
+		actual string
+		diffs  []string
+	}{
+		{"same", `{"_meta": {"version": 2}, "properties": {"fileSize": {"type": "long"}, "id": {"type": "keyword"}}}`, nil},
+		{"changed-type", `{"_meta": {"version": 2}, "properties": {"id": {"type": "text"}, "fileSize": {"type": "long"}}}`, []string{"properties.id.type: expected keyword, found text"}},
+		{"missing", `{"_meta": {"version": 2}, "properties": {"id": {"type": "keyword"}}}`, []string{"properties.fileSize: missing"}},
+		{"unexpected", `{"_meta": {"version": 2}, "properties": {"id": {"type": "keyword"}, "fileSize": {"type": "long"}, "extra": {"type": "text"}}}`, []string{"properties.extra: unexpected"}},
+		{"old-version", `{"_meta": {"version": 1}, "properties": {"id": {"type": "keyword"}, "fileSize": {"type": "long"}}}`, []string{"_meta.version: expected 2, found 1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			diffs := diffMappings("", expected, parse(c.actual))
+			if !reflect.DeepEqual(diffs, c.diffs) {
+				t.Errorf("Got %q instead of expected %q", diffs, c.diffs)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// dryRunHeader is the AMQP header that can be set to true to request a dry run, as an alternative to the dry_run body field
+const dryRunHeader = "dry-run"
+
+// indexMessage is the optional JSON body of the index messages this service consumes. An empty body is the same as an empty object.
+type indexMessage struct {
+	// Since overrides the persisted high-water mark for index.data.since messages
+	Since *time.Time `json:"since,omitempty"`
+
+	// DryRun requests a dry run, and is passed along to any messages published while handling this one
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Path is the collection to reindex for index.path messages
+	Path string `json:"path,omitempty"`
+
+	// User is the user#zone to reindex for index.user messages
+	User string `json:"user,omitempty"`
+
+	// RunID identifies the full reindex a prefix message belongs to in the run ledger
+	RunID string `json:"run_id,omitempty"`
+}
+
+func parseIndexMessage(body []byte) (indexMessage, error) {
+	var msg indexMessage
+	if len(body) == 0 {
+		return msg, nil
+	}
+	err := json.Unmarshal(body, &msg)
+	return msg, err
+}
+
+// encode returns the message body to publish, which is empty if no fields are set so older consumers are unaffected
+func (msg indexMessage) encode() ([]byte, error) {
+	if msg == (indexMessage{}) {
+		return []byte{}, nil
+	}
+	return json.Marshal(msg)
+}
+
+// readIndexMessage parses the body of a delivery and applies any settings given as headers or on the command line
+func readIndexMessage(del amqp.Delivery) (indexMessage, error) {
+	msg, err := parseIndexMessage(del.Body)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.DryRun = msg.DryRun || *dryRun
+
+	switch v := del.Headers[dryRunHeader].(type) {
+	case bool:
+		msg.DryRun = msg.DryRun || v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		msg.DryRun = msg.DryRun || b
+	}
+
+	return msg, nil
+}
+
+func (msg indexMessage) options() ReindexOptions {
+	return ReindexOptions{DryRun: msg.DryRun, RunID: msg.RunID}
+}
+
+// maxPrefixLength is the longest prefix accepted from a routing key, the number of hex digits in a UUID
+const maxPrefixLength = 32
+
+// The reasons a prefix routing key is refused. They're also used as metric labels, so must stay few and fixed.
+var (
+	errMissingPrefix = errors.New("missing prefix")
+	errNonHexPrefix  = errors.New("prefix is not hexadecimal")
+	errLongPrefix    = errors.New("prefix is too long")
+)
+
+// prefixFromRoutingKey returns the UUID prefix at the end of an index.data.prefix routing key, or one of the
+// errors above if it isn't something that can be reindexed
+func prefixFromRoutingKey(routingKey string) (string, error) {
+	prefix, ok := strings.CutPrefix(routingKey, prefixRoutingKey+".")
+	if !ok || prefix == "" {
+		return "", errMissingPrefix
+	}
+	if len(prefix) > maxPrefixLength {
+		return "", errLongPrefix
+	}
+	if !isHexPrefix(prefix) {
+		return "", errNonHexPrefix
+	}
+	return prefix, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestReadIndexMessage(t *testing.T) {
+	cases := []struct {
+		name     string
+		del      amqp.Delivery
+		expected bool
+		err      bool
+	}{
+		{"empty", amqp.Delivery{}, false, false},
+		{"body", amqp.Delivery{Body: []byte(`{"dry_run": true}`)}, true, false},
+		{"header-bool", amqp.Delivery{Headers: amqp.Table{dryRunHeader: true}}, true, false},
+		{"header-string", amqp.Delivery{Headers: amqp.Table{dryRunHeader: "true"}}, true, false},
+		{"header-false", amqp.Delivery{Headers: amqp.Table{dryRunHeader: "false"}}, false, false},
+		{"bad-body", amqp.Delivery{Body: []byte(`not json`)}, false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := readIndexMessage(c.del)
+			if (err != nil) != c.err {
+				t.Fatalf("Got error %v, expected error: %t", err, c.err)
+			}
+			if msg.DryRun != c.expected {
+				t.Errorf("Got %t instead of expected %t", msg.DryRun, c.expected)
+			}
+		})
+	}
+}
+
+func TestIndexMessageEncodeEmpty(t *testing.T) {
+	body, err := indexMessage{}.encode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(body) != 0 {
+		t.Errorf("Expected an empty body, got %q", body)
+	}
+}
+
+func TestPrefixFromRoutingKey(t *testing.T) {
+	cases := []struct {
+		key      string
+		expected string
+		err      error
+	}{
+		{"index.data.prefix.0a1", "0a1", nil},
+		{"index.data.prefix.ABC", "ABC", nil},
+		{"index.data.prefix." + strings.Repeat("f", maxPrefixLength), strings.Repeat("f", maxPrefixLength), nil},
+		{"index.data.prefix", "", errMissingPrefix},
+		{"index.data.prefix.", "", errMissingPrefix},
+		{"index.data.prefixes.0a", "", errMissingPrefix},
+		{"index.data.prefix.0a.1b", "", errNonHexPrefix},
+		{"index.data.prefix.0a'; drop table r_data_main; --", "", errNonHexPrefix},
+		{"index.data.prefix.0a%", "", errNonHexPrefix},
+		{"index.data.prefix." + strings.Repeat("f", maxPrefixLength+1), "", errLongPrefix},
+	}
+
+	for _, c := range cases {
+		t.Run(c.key, func(t *testing.T) {
+			prefix, err := prefixFromRoutingKey(c.key)
+			if err != c.err {
+				t.Fatalf("Got error %v, expected %v", err, c.err)
+			}
+			if prefix != c.expected {
+				t.Errorf("Got prefix %q, expected %q", prefix, c.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "infosquito2"
+
+var (
+	documentsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "documents_total",
+		Help:      "Documents processed, by document type and the action taken for them.",
+	}, []string{"doc_type", "action"})
+
+	updatedFieldsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "updated_fields_total",
+		Help:      "Fields which differed between the ICAT and ES for updated documents.",
+	}, []string{"field"})
+
+	reindexDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "reindex_duration_seconds",
+		Help:      "Time taken by each reindex operation, by scope (prefix, tags, etc.) and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"scope", "result"})
+
+	reindexRows = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "reindex_rows",
+		Help:      "Rows considered by each reindex operation, by scope and result.",
+		Buckets:   prometheus.ExponentialBuckets(10, 4, 8),
+	}, []string{"scope", "result"})
+
+	prefixSplitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prefix_splits_total",
+		Help:      "Prefixes which had too many results and were split.",
+	})
+
+	bulkFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bulk_failures_total",
+		Help:      "Failed bulk indexer operations, by operation.",
+	}, []string{"operation"})
+
+	messagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "amqp_messages_total",
+		Help:      "AMQP messages handled, by routing key (without the prefix) and outcome.",
+	}, []string{"routing_key", "outcome"})
+
+	handlerFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "amqp_handler_failures_total",
+		Help:      "AMQP messages whose handling failed and which were retried or dead-lettered, by routing key (without the prefix).",
+	}, []string{"routing_key"})
+
+	retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "amqp_retries_total",
+		Help:      "Failed AMQP messages scheduled to be retried, by routing key (without the prefix).",
+	}, []string{"routing_key"})
+
+	deadLettersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "amqp_dead_letters_total",
+		Help:      "AMQP messages sent to the dead-letter queue, by routing key (without the prefix).",
+	}, []string{"routing_key"})
+
+	invalidRoutingKeysTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "amqp_invalid_routing_keys_total",
+		Help:      "Prefix messages dead-lettered because their routing key didn't end in a valid prefix, by reason.",
+	}, []string{"reason"})
+
+	handlersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "handlers_busy",
+		Help:      "AMQP message handlers currently doing work.",
+	})
+)
+
+// reindexResult is the result label for a reindex operation which returned err
+func reindexResult(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case err == ErrTooManyResults:
+		return "too_many_results"
+	default:
+		return "error"
+	}
+}
+
+// observeReindex records metrics for a finished reindex operation which returned err. Document counts
+// are only recorded for successful operations, since a failed one may not have written them.
+func observeReindex(scope string, start time.Time, rows *rowMetadata, err error) {
+	result := reindexResult(err)
+	reindexDuration.WithLabelValues(scope, result).Observe(time.Since(start).Seconds())
+	reindexRows.WithLabelValues(scope, result).Observe(float64(rows.rows))
+
+	// nothing was actually written during a dry run
+	if err != nil || rows.report != nil {
+		return
+	}
+
+	counts := []struct {
+		docType, action string
+		n               int64
+	}{
+		{"file", "added", rows.dataobjectsAdded},
+		{"file", "updated", rows.dataobjectsUpdated},
+		{"file", "removed", rows.dataobjectsRemoved},
+		{"folder", "added", rows.collsAdded},
+		{"folder", "updated", rows.collsUpdated},
+		{"folder", "removed", rows.collsRemoved},
+		{"tag", "added", rows.tagsAdded},
+		{"tag", "updated", rows.tagsUpdated},
+		{"tag", "unchanged", rows.tagsUnchanged},
+		{"tag", "removed", rows.tagsRemoved},
+	}
+	for _, c := range counts {
+		if c.n > 0 {
+			documentsTotal.WithLabelValues(c.docType, c.action).Add(float64(c.n))
+		}
+	}
+
+	for field, n := range rows.updatedFields {
+		updatedFieldsTotal.WithLabelValues(field).Add(float64(n))
+	}
+}
+
+// messageKind strips the variable part off of a routing key so it can be used as a metric label
+func messageKind(routingKey string) string {
+	if strings.HasPrefix(routingKey, prefixRoutingKey) {
+		return prefixRoutingKey
+	}
+	if strings.HasPrefix(routingKey, objectRoutingKey+".") {
+		return objectRoutingKey
+	}
+	return routingKey
+}
+
+// meteredIndexer counts failures from an underlying bulkIndexer
+type meteredIndexer struct {
+	bulkIndexer
+}
+
+func (m meteredIndexer) Index(id, doc string) error {
+	// Index and Delete flush once the bulk size is reached, so they can fail the same way Flush does
+	err := m.bulkIndexer.Index(id, doc)
+	if err != nil {
+		bulkFailuresTotal.WithLabelValues("add").Inc()
+	}
+	return err
+}
+
+func (m meteredIndexer) Delete(id string) error {
+	err := m.bulkIndexer.Delete(id)
+	if err != nil {
+		bulkFailuresTotal.WithLabelValues("add").Inc()
+	}
+	return err
+}
+
+func (m meteredIndexer) Flush() error {
+	err := m.bulkIndexer.Flush()
+	if err != nil {
+		bulkFailuresTotal.WithLabelValues("flush").Inc()
+	}
+	return err
+}
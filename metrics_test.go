@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestReindexResult(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{nil, "success"},
+		{ErrTooManyResults, "too_many_results"},
+		{errors.New("connection refused"), "error"},
+	}
+
+	for _, c := range cases {
+		if got := reindexResult(c.err); got != c.expected {
+			t.Errorf("%v: got %s instead of expected %s", c.err, got, c.expected)
+		}
+	}
+}
+
+// countingIndexer counts flushes of an indexer which never has anything pending
+type countingIndexer struct {
+	discardIndexer
+	flushes int
+}
+
+func (c *countingIndexer) Flush() error {
+	c.flushes++
+	return errors.New("No bulk actions to commit")
+}
+
+func TestFlushIfPendingSkipsEmptyBatch(t *testing.T) {
+	indexer := &countingIndexer{}
+	if err := flushIfPending(indexer); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if indexer.flushes != 0 {
+		t.Errorf("Got %d flushes of an empty batch", indexer.flushes)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+)
+
+const objectRoutingKey string = "index.object"
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// isUUID returns true if the given string is a UUID in the canonical hyphenated form, in either case
+func isUUID(s string) bool {
+	return uuidPattern.MatchString(strings.ToLower(s))
+}
+
+func createObjectBaseUuidsTable(context context.Context, log *logrus.Entry, uuid string, tx *ICATTx) (int64, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "createObjectBaseUuidsTable")
+	defer span.End()
+
+	r, err := tx.CreateTemporaryTable(ctx, "base_object_uuids", "SELECT meta.meta_id, lower(meta.meta_attr_value) as id FROM r_meta_main meta WHERE meta.meta_attr_name = 'ipc_UUID' AND meta.meta_attr_value IN ($1, upper($1))", uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("Got %d rows for object %s", r, uuid)
+	return r, nil
+}
+
+// ReindexObject reindexes a single data object or collection by UUID, indexing or updating its
+// document if it's in the ICAT and deleting the document if it isn't.
+func ReindexObject(context context.Context, icat *ICATConnection, dedb *DEDBConnection, es SearchBackend, uuid, irodsZone string, opts ReindexOptions) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "ReindexObject")
+	defer span.End()
+
+	if !isUUID(uuid) {
+		return errors.Errorf("Invalid object UUID %q", uuid)
+	}
+	uuid = strings.ToLower(uuid)
+
+	objectlog := log.WithFields(logrus.Fields{
+		"object": uuid,
+	})
+	objectlog.Debugf("Indexing object %s", uuid)
+
+	return reindexSelected(ctx, objectlog, icat, dedb, es, objectUuids(uuid), []string{uuid}, irodsZone, "object", uuid, opts)
+}
+
+func objectUuids(uuid string) baseUuidsCreator {
+	return func(ctx context.Context, log *logrus.Entry, tx *ICATTx) (int64, error) {
+		return createObjectBaseUuidsTable(ctx, log, uuid, tx)
+	}
+}
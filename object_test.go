@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestIsUUID(t *testing.T) {
+	cases := []struct {
+		id       string
+		expected bool
+	}{
+		{"0f2c6a0e-4b7e-11e5-9c4a-3c4a92e4a804", true},
+		{"0F2C6A0E-4B7E-11E5-9C4A-3C4A92E4A804", true},
+		{"0f2c6a0e4b7e11e59c4a3c4a92e4a804", false},
+		{"0f2c6a0e-4b7e-11e5-9c4a-3c4a92e4a80", false},
+		{"0f2c6a0e-4b7e-11e5-9c4a-3c4a92e4a80g", false},
+		{"", false},
+		{"*", false},
+	}
+
+	for _, c := range cases {
+		if got := isUUID(c.id); got != c.expected {
+			t.Errorf("isUUID(%q): got %t instead of expected %t", c.id, got, c.expected)
+		}
+	}
+}
+
+func TestUUIDCaseVariants(t *testing.T) {
+	got := uuidCaseVariants([]string{"0f2c6a0e-4b7e-11e5-9c4a-3c4a92e4a804"})
+	expected := []string{"0f2c6a0e-4b7e-11e5-9c4a-3c4a92e4a804", "0F2C6A0E-4B7E-11E5-9C4A-3C4A92E4A804"}
+	if len(got) != len(expected) {
+		t.Fatalf("Got %q instead of expected %q", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Got %q instead of expected %q", got, expected)
+		}
+	}
+}
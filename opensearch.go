@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// OpenSearchConnection talks to an OpenSearch cluster over its REST API, along with an index to use.
+// olivere/elastic refuses to talk to OpenSearch 2.x, and the requests needed here are few and simple.
+type OpenSearchConnection struct {
+	client   *http.Client
+	base     string
+	user     string
+	password string
+	index    string
+}
+
+// openSearchError is returned for requests OpenSearch responded to with an error status
+type openSearchError struct {
+	Status int
+	Body   string
+}
+
+func (e *openSearchError) Error() string {
+	return fmt.Sprintf("OpenSearch returned %d: %s", e.Status, e.Body)
+}
+
+// isOpenSearchNotFound returns true if err is a 404 response from OpenSearch
+func isOpenSearchNotFound(err error) bool {
+	var osErr *openSearchError
+	return errors.As(err, &osErr) && osErr.Status == http.StatusNotFound
+}
+
+// SetupOpenSearch initializes an OpenSearchConnection for use
+func SetupOpenSearch(base, user, password, index string) (*OpenSearchConnection, error) {
+	osc := &OpenSearchConnection{client: &httpClient, base: strings.TrimSuffix(base, "/"), user: user, password: password, index: index}
+
+	wait := "10s"
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var health struct {
+		TimedOut bool `json:"timed_out"`
+	}
+	err := osc.do(ctx, http.MethodGet, "/_cluster/health?wait_for_status=yellow&timeout="+wait, nil, &health)
+	if err == nil && health.TimedOut {
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cluster did not report yellow or better status within %s", wait)
+	}
+
+	return osc, nil
+}
+
+// do sends a request with a JSON body, unless body is nil, and decodes the JSON response into out, unless it's nil
+func (osc *OpenSearchConnection) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "Unable to encode request")
+		}
+		r = bytes.NewReader(b)
+	}
+	return osc.doRaw(ctx, method, path, "application/json", r, out)
+}
+
+// doRaw sends a request with the given body and content type and decodes the JSON response into out, unless it's nil
+func (osc *OpenSearchConnection) doRaw(ctx context.Context, method, path, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, osc.base+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if osc.user != "" {
+		req.SetBasicAuth(osc.user, osc.password)
+	}
+
+	res, err := osc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer logIfErr(res.Body.Close, "closing OpenSearch response body")
+
+	if res.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return &openSearchError{Status: res.StatusCode, Body: string(b)}
+	}
+	if out == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+		return err
+	}
+	return errors.Wrapf(json.NewDecoder(res.Body).Decode(out), "Unable to decode response to %s %s", method, path)
+}
+
+// indexPath returns the escaped, comma-separated path component for the given indices
+func indexPath(indices ...string) string {
+	escaped := make([]string, len(indices))
+	for i, index := range indices {
+		escaped[i] = url.PathEscape(index)
+	}
+	return "/" + strings.Join(escaped, ",")
+}
+
+// Index returns the name of the index this connection reads and writes
+func (osc *OpenSearchConnection) Index() string {
+	return osc.index
+}
+
+// WithIndex returns a connection sharing the same client which reads and writes the given index instead
+func (osc *OpenSearchConnection) WithIndex(index string) SearchBackend {
+	c := *osc
+	c.index = index
+	return &c
+}
+
+// SearchAll pages through every hit for query using a point in time and search_after, the same way
+// ESConnection does. Points in time need OpenSearch 2.4 or later.
+func (osc *OpenSearchConnection) SearchAll(ctx context.Context, query searchQuery, fields []string, fn func(total int64, hits []searchHit) error) error {
+	var pit struct {
+		PitID string `json:"pit_id"`
+	}
+	err := osc.do(ctx, http.MethodPost, indexPath(osc.index)+"/_search/point_in_time?keep_alive="+pitKeepAlive, nil, &pit)
+	if err != nil {
+		return errors.Wrap(err, "Unable to open point in time")
+	}
+	defer func() {
+		// the caller's context may be done by now, and the point in time should be closed regardless
+		body := map[string]interface{}{"pit_id": []string{pit.PitID}}
+		if err := osc.do(context.Background(), http.MethodDelete, "/_search/point_in_time", body, nil); err != nil {
+			log.Debugf("Failed closing point in time: %s", err)
+		}
+	}()
+
+	var after []interface{}
+	for {
+		search := map[string]interface{}{
+			"pit":              map[string]interface{}{"id": pit.PitID, "keep_alive": pitKeepAlive},
+			"query":            query,
+			"sort":             []interface{}{map[string]interface{}{"id": map[string]interface{}{"order": "asc"}}},
+			"_source":          map[string]interface{}{"includes": fields},
+			"track_total_hits": true,
+			"size":             searchPageSize,
+		}
+		if after != nil {
+			search["search_after"] = after
+		}
+
+		var res struct {
+			PitID string `json:"pit_id"`
+			Hits  struct {
+				Total struct {
+					Value int64 `json:"value"`
+				} `json:"total"`
+				Hits []struct {
+					ID     string          `json:"_id"`
+					Source json.RawMessage `json:"_source"`
+					Sort   []interface{}   `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		if err = osc.do(ctx, http.MethodPost, "/_search", search, &res); err != nil {
+			return err
+		}
+		if res.PitID != "" {
+			pit.PitID = res.PitID
+		}
+
+		hits := res.Hits.Hits
+		if len(hits) == 0 {
+			return nil
+		}
+		page := make([]searchHit, len(hits))
+		for i, hit := range hits {
+			page[i] = searchHit{ID: hit.ID, Source: hit.Source}
+		}
+		if err = fn(res.Hits.Total.Value, page); err != nil {
+			return err
+		}
+		if len(hits) < searchPageSize {
+			return nil
+		}
+		after = hits[len(hits)-1].Sort
+	}
+}
+
+// openSearchBulkIndexer batches requests for the _bulk API, flushing once bulkSize have been added
+type openSearchBulkIndexer struct {
+	ctx      context.Context
+	osc      *OpenSearchConnection
+	bulkSize int
+	count    int
+	body     bytes.Buffer
+}
+
+// NewBulkIndexer returns a bulkIndexer for this connection's index given a size
+func (osc *OpenSearchConnection) NewBulkIndexer(ctx context.Context, bulkSize int) bulkIndexer {
+	return &openSearchBulkIndexer{ctx: ctx, osc: osc, bulkSize: bulkSize}
+}
+
+func (b *openSearchBulkIndexer) add(action string, id string, doc string) error {
+	meta, err := json.Marshal(map[string]interface{}{action: map[string]string{"_index": b.osc.index, "_id": id}})
+	if err != nil {
+		return err
+	}
+	b.body.Write(meta)
+	b.body.WriteByte('\n')
+	if doc != "" {
+		b.body.WriteString(doc)
+		b.body.WriteByte('\n')
+	}
+	b.count++
+
+	if b.count >= b.bulkSize {
+		return b.Flush()
+	}
+	return nil
+}
+
+func (b *openSearchBulkIndexer) Index(id, doc string) error {
+	return b.add("index", id, doc)
+}
+
+func (b *openSearchBulkIndexer) Delete(id string) error {
+	return b.add("delete", id, "")
+}
+
+func (b *openSearchBulkIndexer) CanFlush() bool {
+	return b.count > 0
+}
+
+// Flush sends the pending requests. Failures of individual requests are returned as an error, except
+// for deletes of documents that are already gone.
+func (b *openSearchBulkIndexer) Flush() error {
+	if b.count == 0 {
+		return nil
+	}
+	body := bytes.NewReader(b.body.Bytes())
+	b.body.Reset()
+	b.count = 0
+
+	var res struct {
+		Errors bool                                    `json:"errors"`
+		Items  []map[string]openSearchBulkItemResponse `json:"items"`
+	}
+	if err := b.osc.doRaw(b.ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body, &res); err != nil {
+		return err
+	}
+	if !res.Errors {
+		return nil
+	}
+
+	var failed []string
+	for _, item := range res.Items {
+		for action, r := range item {
+			if r.Status < 300 || (action == "delete" && r.Status == http.StatusNotFound) {
+				continue
+			}
+			failed = append(failed, fmt.Sprintf("%s %s: %d %s", action, r.ID, r.Status, r.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.Errorf("%d bulk requests failed, first: %s", len(failed), failed[0])
+}
+
+// openSearchBulkItemResponse is the result of one request in a _bulk call
+type openSearchBulkItemResponse struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// Ping checks that the cluster is reachable and not reporting red status
+func (osc *OpenSearchConnection) Ping(ctx context.Context) error {
+	var health struct {
+		ClusterName string `json:"cluster_name"`
+		Status      string `json:"status"`
+	}
+	if err := osc.do(ctx, http.MethodGet, "/_cluster/health", nil, &health); err != nil {
+		return err
+	}
+	if health.Status == "red" {
+		return errors.Errorf("Cluster %s reports red status", health.ClusterName)
+	}
+	return nil
+}
+
+// acknowledged is the response to index and alias changes
+type acknowledged struct {
+	Acknowledged bool `json:"acknowledged"`
+}
+
+// CreateIndex creates a new index with the bundled settings and mappings
+func (osc *OpenSearchConnection) CreateIndex(ctx context.Context, index string) error {
+	var res acknowledged
+	err := osc.doRaw(ctx, http.MethodPut, indexPath(index), "application/json", strings.NewReader(dataIndexBody), &res)
+	if err != nil {
+		return err
+	}
+	if !res.Acknowledged {
+		return errors.Errorf("Creating index %s was not acknowledged", index)
+	}
+	return nil
+}
+
+// CountDocuments refreshes the given index and returns how many documents of the given types it holds
+func (osc *OpenSearchConnection) CountDocuments(ctx context.Context, index string, docTypes ...string) (int64, error) {
+	if err := osc.do(ctx, http.MethodPost, indexPath(index)+"/_refresh", nil, nil); err != nil {
+		return 0, err
+	}
+
+	var res struct {
+		Count int64 `json:"count"`
+	}
+	err := osc.do(ctx, http.MethodPost, indexPath(index)+"/_count", map[string]interface{}{"query": docTypesQuery(docTypes...)}, &res)
+	return res.Count, err
+}
+
+// AliasedIndices returns the indices behind the given alias. If name is a concrete index rather
+// than an alias, it's returned with isIndex set. Nothing is returned if it doesn't exist at all.
+func (osc *OpenSearchConnection) AliasedIndices(ctx context.Context, name string) (indices []string, isIndex bool, err error) {
+	var res map[string]struct {
+		Aliases map[string]interface{} `json:"aliases"`
+	}
+	err = osc.do(ctx, http.MethodGet, indexPath(name)+"/_alias", nil, &res)
+	if isOpenSearchNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if _, ok := res[name]; ok {
+		return []string{name}, true, nil
+	}
+	for index, entry := range res {
+		if _, ok := entry.Aliases[name]; ok {
+			indices = append(indices, index)
+		}
+	}
+	return indices, false, nil
+}
+
+// SwapAlias atomically points alias at index instead of the old indices. If the alias name is
+// currently taken by a concrete index, that index is deleted in the same operation.
+func (osc *OpenSearchConnection) SwapAlias(ctx context.Context, alias, index string, old []string, replaceIndex bool) error {
+	var actions []interface{}
+	if replaceIndex {
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": alias}})
+	} else if len(old) > 0 {
+		actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"indices": old, "alias": alias}})
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]interface{}{"index": index, "alias": alias}})
+
+	var res acknowledged
+	if err := osc.do(ctx, http.MethodPost, "/_aliases", map[string]interface{}{"actions": actions}, &res); err != nil {
+		return err
+	}
+	if !res.Acknowledged {
+		return errors.Errorf("Pointing alias %s at %s was not acknowledged", alias, index)
+	}
+	return nil
+}
+
+// DeleteIndices deletes the given indices
+func (osc *OpenSearchConnection) DeleteIndices(ctx context.Context, indices ...string) error {
+	return osc.do(ctx, http.MethodDelete, indexPath(indices...), nil, nil)
+}
+
+// GetMappings returns the mappings of each of the given indices, keyed by index name
+func (osc *OpenSearchConnection) GetMappings(ctx context.Context, indices ...string) (map[string]map[string]interface{}, error) {
+	var res map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := osc.do(ctx, http.MethodGet, indexPath(indices...)+"/_mapping", nil, &res); err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[string]map[string]interface{})
+	for index, entry := range res {
+		mappings[index] = entry.Mappings
+	}
+	return mappings, nil
+}
+
+// GetAnalysis returns the analysis settings of each of the given indices, keyed by index name
+func (osc *OpenSearchConnection) GetAnalysis(ctx context.Context, indices ...string) (map[string]map[string]interface{}, error) {
+	var res map[string]struct {
+		Settings struct {
+			Index struct {
+				Analysis map[string]interface{} `json:"analysis"`
+			} `json:"index"`
+		} `json:"settings"`
+	}
+	if err := osc.do(ctx, http.MethodGet, indexPath(indices...)+"/_settings", nil, &res); err != nil {
+		return nil, err
+	}
+
+	analysis := make(map[string]map[string]interface{})
+	for index, entry := range res {
+		analysis[index] = entry.Settings.Index.Analysis
+	}
+	return analysis, nil
+}
+
+// Close releases idle connections. The HTTP client is shared, so there's nothing else to stop.
+func (osc *OpenSearchConnection) Close() {
+	osc.client.CloseIdleConnections()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestOpenSearch(t *testing.T, handler http.HandlerFunc) *OpenSearchConnection {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &OpenSearchConnection{client: srv.Client(), base: srv.URL, index: "data"}
+}
+
+func TestOpenSearchSearchAll(t *testing.T) {
+	var closed bool
+	osc := newTestOpenSearch(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/data/_search/point_in_time":
+			io.WriteString(w, `{"pit_id": "pit1"}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/_search":
+			var body map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("Unable to decode search body: %s", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if pit, _ := body["pit"].(map[string]interface{}); pit["id"] != "pit1" {
+				t.Errorf("Search used point in time %v", body["pit"])
+			}
+			io.WriteString(w, `{"pit_id": "pit2", "hits": {"total": {"value": 2}, "hits": [
+				{"_id": "a", "_source": {"id": "a"}, "sort": ["a"]},
+				{"_id": "b", "_source": {"id": "b"}, "sort": ["b"]}]}}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/_search/point_in_time":
+			b, _ := io.ReadAll(r.Body)
+			if !strings.Contains(string(b), "pit2") {
+				t.Errorf("Closed point in time with %s, expected the latest ID", b)
+			}
+			closed = true
+			io.WriteString(w, `{}`)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	var ids []string
+	var total int64
+	err := osc.SearchAll(context.Background(), docTypesQuery("file"), []string{"id"}, func(t int64, hits []searchHit) error {
+		total = t
+		for _, hit := range hits {
+			ids = append(ids, hit.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || strings.Join(ids, ",") != "a,b" {
+		t.Errorf("Got %d total and hits %v, expected 2 and [a b]", total, ids)
+	}
+	if !closed {
+		t.Error("Point in time was not closed")
+	}
+}
+
+func TestOpenSearchBulkIndexer(t *testing.T) {
+	cases := []struct {
+		name     string
+		response string
+		err      bool
+	}{
+		{"success", `{"errors": false, "items": []}`, false},
+		{"missing delete", `{"errors": true, "items": [{"index": {"_id": "a", "status": 201}}, {"delete": {"_id": "b", "status": 404}}]}`, false},
+		{"failed index", `{"errors": true, "items": [{"index": {"_id": "a", "status": 400, "error": {"type": "mapper_parsing_exception"}}}, {"delete": {"_id": "b", "status": 200}}]}`, true},
+	}
+
+	for _, c := range cases {
+		var body string
+		osc := newTestOpenSearch(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/_bulk" {
+				t.Errorf("%s: unexpected request %s %s", c.name, r.Method, r.URL)
+			}
+			b, _ := io.ReadAll(r.Body)
+			body = string(b)
+			io.WriteString(w, c.response)
+		})
+
+		indexer := osc.NewBulkIndexer(context.Background(), 10)
+		if err := indexer.Index("a", `{"id":"a"}`); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if err := indexer.Delete("b"); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !indexer.CanFlush() {
+			t.Errorf("%s: expected pending requests", c.name)
+		}
+
+		err := indexer.Flush()
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, expected error: %t", c.name, err, c.err)
+		}
+		expected := `{"index":{"_id":"a","_index":"data"}}` + "\n" + `{"id":"a"}` + "\n" + `{"delete":{"_id":"b","_index":"data"}}` + "\n"
+		if body != expected {
+			t.Errorf("%s: sent %q instead of expected %q", c.name, body, expected)
+		}
+		if indexer.CanFlush() {
+			t.Errorf("%s: expected nothing pending after flushing", c.name)
+		}
+	}
+}
+
+func TestOpenSearchGetAnalysis(t *testing.T) {
+	osc := newTestOpenSearch(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/data-1/_settings" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"data-1": {"settings": {"index": {"number_of_shards": "5", "analysis": {
+			"tokenizer": {"irods_path": {"type": "path_hierarchy", "delimiter": "/"}},
+			"analyzer": {
+				"irods_path": {"type": "custom", "tokenizer": "irods_path"},
+				"irods_entity": {"type": "custom", "tokenizer": "standard", "filter": ["lowercase"]}}}}}}}`)
+	})
+
+	expected, err := bundledDefinition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	analysis, err := osc.GetAnalysis(context.Background(), "data-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drift := diffMappings("settings.analysis", expected.Settings.Analysis, analysis["data-1"])
+	want := []string{"settings.analysis.analyzer.irods_entity.tokenizer: expected keyword, found standard"}
+	if strings.Join(drift, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Got drift %v, expected %v", drift, want)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+)
+
+const pathRoutingKey string = "index.path"
+
+// likeEscaper escapes the characters that are special in a LIKE pattern, using the default escape character
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// cleanCollectionPath validates an absolute iRODS collection path and strips any trailing slash
+func cleanCollectionPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", errors.Errorf("Path %q is not absolute", p)
+	}
+	cleaned := path.Clean(p)
+	if cleaned == "/" {
+		return "", errors.New("Refusing to reindex the whole tree by path, use a full reindex instead")
+	}
+	return cleaned, nil
+}
+
+func createPathBaseUuidsTable(context context.Context, log *logrus.Entry, collPath string, tx *ICATTx) (int64, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "createPathBaseUuidsTable")
+	defer span.End()
+
+	r, err := tx.CreateTemporaryTable(ctx, "base_object_uuids", `SELECT DISTINCT meta.meta_id, lower(meta.meta_attr_value) as id
+  FROM r_meta_main meta
+  JOIN r_objt_metamap map ON map.meta_id = meta.meta_id
+ WHERE meta.meta_attr_name = 'ipc_UUID'
+   AND map.object_id IN (SELECT coll_id FROM r_coll_main WHERE coll_name = $1 OR coll_name LIKE $2
+                         UNION SELECT d.data_id FROM r_data_main d JOIN r_coll_main c ON d.coll_id = c.coll_id WHERE c.coll_name = $1 OR c.coll_name LIKE $2)`,
+		collPath, likeEscaper.Replace(collPath)+"/%")
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("Got %d rows under %s", r, collPath)
+	return r, nil
+}
+
+// ReindexPath reindexes the collection at the given path and every data object and collection beneath it.
+// Objects which have been deleted or moved away leave nothing under the path to find, so they are left for the next prefix reindex to remove.
+func ReindexPath(context context.Context, icat *ICATConnection, dedb *DEDBConnection, es SearchBackend, collPath, irodsZone string, opts ReindexOptions) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "ReindexPath")
+	defer span.End()
+
+	collPath, err := cleanCollectionPath(collPath)
+	if err != nil {
+		return err
+	}
+
+	pathlog := log.WithFields(logrus.Fields{
+		"path": collPath,
+	})
+	pathlog.Debugf("Indexing objects under %s", collPath)
+
+	return reindexSelected(ctx, pathlog, icat, dedb, es, pathUuids(collPath), nil, irodsZone, "path", collPath, opts)
+}
+
+func pathUuids(collPath string) baseUuidsCreator {
+	return func(ctx context.Context, log *logrus.Entry, tx *ICATTx) (int64, error) {
+		return createPathBaseUuidsTable(ctx, log, collPath, tx)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestCleanCollectionPath(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected string
+		err      bool
+	}{
+		{"/iplant/home/ipcdev", "/iplant/home/ipcdev", false},
+		{"/iplant/home/ipcdev/", "/iplant/home/ipcdev", false},
+		{"/iplant//home/./ipcdev", "/iplant/home/ipcdev", false},
+		{"iplant/home/ipcdev", "", true},
+		{"", "", true},
+		{"/", "", true},
+		{"/..", "", true},
+	}
+
+	for _, c := range cases {
+		got, err := cleanCollectionPath(c.path)
+		if (err != nil) != c.err {
+			t.Errorf("%q: got error %v, expected error: %t", c.path, err, c.err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("%q: got %q instead of expected %q", c.path, got, c.expected)
+		}
+	}
+}
+
+func TestLikeEscaper(t *testing.T) {
+	got := likeEscaper.Replace(`/iplant/home/a_b/100%\x`)
+	expected := `/iplant/home/a\_b/100\%\\x`
+	if got != expected {
+		t.Errorf("Got %q instead of expected %q", got, expected)
+	}
+}
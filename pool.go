@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressTracker records when message handling last made progress, so a wedged handler can be told
+// apart from one which is just busy
+type progressTracker struct {
+	last atomic.Int64
+}
+
+// progress is beaten as messages are picked up and finished, and as rows and documents are processed
+var progress progressTracker
+
+func (p *progressTracker) beat() {
+	p.last.Store(time.Now().UnixNano())
+}
+
+// since returns how long it's been since the last beat
+func (p *progressTracker) since() time.Duration {
+	return time.Since(time.Unix(0, p.last.Load()))
+}
+
+// handlerPool bounds how many AMQP messages are handled at once, and tracks them so they can be drained on shutdown
+type handlerPool struct {
+	slots chan struct{}
+
+	mu       sync.Mutex
+	draining bool
+	drainCh  chan struct{}
+	inflight sync.WaitGroup
+
+	// ctx is canceled to abandon in-flight handlers when draining takes too long
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newHandlerPool(size int) *handlerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &handlerPool{
+		slots:   make(chan struct{}, size),
+		drainCh: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// acquire blocks until a handler is free, and returns a function to release it. It returns false
+// without blocking further if the pool is draining, in which case the message shouldn't be handled.
+func (p *handlerPool) acquire(routingKey string) (func(), bool) {
+	p.mu.Lock()
+	if p.draining {
+		p.mu.Unlock()
+		return nil, false
+	}
+	p.inflight.Add(1)
+	p.mu.Unlock()
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		log.Debugf("All %d handlers busy, %s waiting", cap(p.slots), routingKey)
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.drainCh:
+			p.inflight.Done()
+			return nil, false
+		}
+	}
+	handlersBusy.Inc()
+	progress.beat()
+
+	return func() {
+		progress.beat()
+		handlersBusy.Dec()
+		<-p.slots
+		p.inflight.Done()
+	}, true
+}
+
+// context derives a handler context from parent which is also canceled if the pool abandons its handlers
+func (p *handlerPool) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(p.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// drain stops new messages from being handled and waits for in-flight handlers to finish. If ctx
+// ends first, the in-flight handlers' contexts are canceled and ctx's error is returned.
+func (p *handlerPool) drain(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.draining {
+		p.draining = true
+		close(p.drainCh)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
+
+// stalled returns an error if handlers are busy but nothing has made progress for longer than timeout
+func (p *handlerPool) stalled(timeout time.Duration) error {
+	busy := len(p.slots)
+	if busy == 0 {
+		return nil
+	}
+	if since := progress.since(); since > timeout {
+		return fmt.Errorf("%d handlers busy with no progress for %s", busy, since.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHandlerPoolDrain(t *testing.T) {
+	p := newHandlerPool(2)
+
+	release, ok := p.acquire("index.tags")
+	if !ok {
+		t.Fatal("Expected to acquire a handler")
+	}
+
+	drained := make(chan error)
+	go func() {
+		drained <- p.drain(context.Background())
+	}()
+
+	// wait for draining to start, after which new messages are turned away
+	for {
+		p.mu.Lock()
+		draining := p.draining
+		p.mu.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := p.acquire("index.tags"); ok {
+		t.Error("Expected acquire to fail while draining")
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("Drain finished with a handler still in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	release()
+	if err := <-drained; err != nil {
+		t.Errorf("Unexpected drain error: %s", err)
+	}
+}
+
+func TestHandlerPoolDrainTimeoutCancels(t *testing.T) {
+	p := newHandlerPool(1)
+
+	release, ok := p.acquire("index.tags")
+	if !ok {
+		t.Fatal("Expected to acquire a handler")
+	}
+	defer release()
+
+	ctx, cancel := p.context(context.Background())
+	defer cancel()
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelDrain()
+	if err := p.drain(drainCtx); err == nil {
+		t.Fatal("Expected drain to time out")
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected the handler context to be canceled")
+	}
+}
+
+func TestHandlerPoolStalled(t *testing.T) {
+	p := newHandlerPool(1)
+	if err := p.stalled(time.Minute); err != nil {
+		t.Errorf("Idle pool reported stalled: %s", err)
+	}
+
+	release, ok := p.acquire("index.tags")
+	if !ok {
+		t.Fatal("Expected to acquire a handler")
+	}
+	defer release()
+
+	if err := p.stalled(time.Minute); err != nil {
+		t.Errorf("Busy pool which just made progress reported stalled: %s", err)
+	}
+
+	progress.last.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	if err := p.stalled(time.Minute); err == nil {
+		t.Error("Expected a busy pool with no recent progress to be stalled")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rebuilder reindexes everything into a fresh index and then points the configured index name, as an alias, at it
+type rebuilder struct {
+	icat   *ICATConnection
+	dedb   *DEDBConnection
+	es     SearchBackend
+	ledger *runLedger
+
+	workers int
+
+	// tolerance is the fraction by which document counts may differ from the databases, since they change during the rebuild
+	tolerance float64
+
+	// deleteOld deletes the indices the alias pointed at once it has been swapped
+	deleteOld bool
+}
+
+// newIndexName returns the name of a rebuilt index for the given alias
+func newIndexName(alias string, now time.Time) string {
+	return fmt.Sprintf("%s-%s", alias, now.UTC().Format("20060102t150405"))
+}
+
+// withinTolerance returns true if actual is within the given fraction of expected
+func withinTolerance(expected, actual int64, tolerance float64) bool {
+	diff := expected - actual
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) <= tolerance*float64(max(expected, 1))
+}
+
+// run performs the rebuild. The alias is only swapped once the new index has been fully populated
+// and validated; on failure the new index is left in place for inspection.
+//
+// Changes made while the rebuild runs are caught up by reindexing what was modified since it started, twice:
+// once before validating and again just before the swap, for changes made during the first catch-up. That
+// only finds objects and tags which still exist, so anything deleted during the rebuild stays in the new
+// index until the next periodic full reindex removes it.
+func (r *rebuilder) run(ctx context.Context, stop <-chan struct{}) error {
+	alias := r.es.Index()
+	old, isIndex, err := r.es.AliasedIndices(ctx, alias)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to look up alias %s", alias)
+	}
+	if isIndex && !r.deleteOld {
+		return errors.Errorf("%s is an index rather than an alias, rerun with --delete-old to replace it", alias)
+	}
+
+	start := time.Now()
+	index := newIndexName(alias, start)
+	if err = r.es.CreateIndex(ctx, index); err != nil {
+		return errors.Wrapf(err, "Unable to create index %s", index)
+	}
+	log.Infof("Rebuilding %s into new index %s", alias, index)
+
+	target := r.es.WithIndex(index)
+	full := &fullReindexer{icat: r.icat, dedb: r.dedb, es: target, ledger: r.ledger, workers: r.workers}
+	if err = full.run(ctx, stop); err != nil {
+		return errors.Wrapf(err, "Rebuilding %s failed, leaving it in place", index)
+	}
+
+	// pick up anything changed in the old index while the new one was being built
+	caughtUp, err := r.catchUp(ctx, target, start)
+	if err != nil {
+		return err
+	}
+
+	if err = r.validate(ctx, index); err != nil {
+		return errors.Wrapf(err, "Validating %s failed, leaving it in place", index)
+	}
+
+	// and anything changed since then, to keep the gap before the swap as short as possible
+	if _, err = r.catchUp(ctx, target, caughtUp); err != nil {
+		return err
+	}
+
+	if err = r.es.SwapAlias(ctx, alias, index, old, isIndex); err != nil {
+		return errors.Wrapf(err, "Unable to point %s at %s", alias, index)
+	}
+	log.Infof("Alias %s now points at %s", alias, index)
+
+	if r.deleteOld && !isIndex && len(old) > 0 {
+		if err = r.es.DeleteIndices(ctx, old...); err != nil {
+			return errors.Wrapf(err, "Unable to delete old indices %v", old)
+		}
+		log.Infof("Deleted old indices %v", old)
+	}
+	return nil
+}
+
+// catchUp reindexes into target everything modified since the given time, returning when it started so
+// the next catch-up can carry on from there
+func (r *rebuilder) catchUp(ctx context.Context, target SearchBackend, since time.Time) (time.Time, error) {
+	start := time.Now()
+	log.Infof("Catching up %s on changes since %s", target.Index(), since)
+	if err := ReindexSince(ctx, r.icat, r.dedb, target, since, irodsZone, ReindexOptions{}); err != nil {
+		return start, errors.Wrapf(err, "Catching up %s on changes since %s failed, leaving it in place", target.Index(), since)
+	}
+	return start, nil
+}
+
+// validate compares the document counts in the new index with the ICAT and DE database
+func (r *rebuilder) validate(ctx context.Context, index string) error {
+	objects, err := r.icat.CountObjects(ctx, irodsZone)
+	if err != nil {
+		return errors.Wrap(err, "Unable to count ICAT objects")
+	}
+	objectDocs, err := r.es.CountDocuments(ctx, index, "file", "folder")
+	if err != nil {
+		return errors.Wrap(err, "Unable to count file and folder documents")
+	}
+	log.Infof("%s has %d file and folder documents for %d ICAT objects", index, objectDocs, objects)
+	if !withinTolerance(objects, objectDocs, r.tolerance) {
+		return errors.Errorf("%d file and folder documents is not within %g of %d ICAT objects", objectDocs, r.tolerance, objects)
+	}
+
+	tags, err := r.dedb.CountTags(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Unable to count tags")
+	}
+	tagDocs, err := r.es.CountDocuments(ctx, index, "tag")
+	if err != nil {
+		return errors.Wrap(err, "Unable to count tag documents")
+	}
+	log.Infof("%s has %d tag documents for %d tags", index, tagDocs, tags)
+	if !withinTolerance(tags, tagDocs, r.tolerance) {
+		return errors.Errorf("%d tag documents is not within %g of %d tags", tagDocs, r.tolerance, tags)
+	}
+	return nil
+}
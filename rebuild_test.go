@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithinTolerance(t *testing.T) {
+	cases := []struct {
+		expected, actual int64
+		tolerance        float64
+		within           bool
+	}{
+		{1000, 1000, 0, true},
+		{1000, 999, 0, false},
+		{1000, 999, 0.001, true},
+		{1000, 1001, 0.001, true},
+		{1000, 998, 0.001, false},
+		{0, 0, 0, true},
+		{0, 1, 0.001, false},
+	}
+
+	for _, c := range cases {
+		if got := withinTolerance(c.expected, c.actual, c.tolerance); got != c.within {
+			t.Errorf("withinTolerance(%d, %d, %g): got %t instead of expected %t", c.expected, c.actual, c.tolerance, got, c.within)
+		}
+	}
+}
+
+func TestNewIndexName(t *testing.T) {
+	got := newIndexName("data", time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC))
+	if got != "data-20240305t140709" {
+		t.Errorf("Got %s instead of expected data-20240305t140709", got)
+	}
+}
@@ -4,14 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
 
-	"github.com/cyverse-de/esutils/v3"
-	"github.com/olivere/elastic/v7"
 	"github.com/sirupsen/logrus"
 )
 
@@ -49,10 +49,32 @@ type rowMetadata struct {
 	collsUpdated       int64
 	collsRemoved       int64
 	tags               int64
+	tagsAdded          int64
+	tagsUpdated        int64
+	tagsUnchanged      int64
 	tagsRemoved        int64
+	tagTargetsDropped  int64
+
+	// updatedFields counts, per field, how many updated documents differed in it
+	updatedFields map[string]int64
+
+	// report collects planned actions during a dry run and is nil otherwise
+	report *dryRunReport
+}
+
+// ReindexOptions holds settings that apply to a whole reindex operation
+type ReindexOptions struct {
+	// DryRun classifies documents as usual but records the resulting actions instead of sending them to ES
+	DryRun bool
+
+	// RunID identifies the full reindex this operation is part of, if any, for the run ledger
+	RunID string
 }
 
 func logTime(prefixlog *logrus.Entry, start time.Time, rows *rowMetadata) {
+	if len(rows.updatedFields) > 0 {
+		prefixlog.Debugf("Updated documents differed in fields: %v", rows.updatedFields)
+	}
 	prefixlog.Infof("Processed %d entries (%d rows, %d documents, processed %d data objects (+%d,U%d,-%d), %d colls (+%d,U%d,-%d)) in %s", rows.processed, rows.rows, rows.documents, rows.dataobjects, rows.dataobjectsAdded, rows.dataobjectsUpdated, rows.dataobjectsRemoved, rows.colls, rows.collsAdded, rows.collsUpdated, rows.collsRemoved, time.Since(start).String())
 }
 
@@ -65,29 +87,14 @@ func createBaseUuidsTable(context context.Context, log *logrus.Entry, prefix str
 		return 0, err
 	}
 
-	if r > int64(maxInPrefix) {
-		return r, ErrTooManyResults
-	}
-
 	log.Debugf("Got %d rows for prefix %s (note that this may include stale unused metadata)", r, prefix)
 	return r, nil
 }
 
-func createUuidsTable(context context.Context, log *logrus.Entry, prefix string, tx *ICATTx) (int64, error) {
-	ctx, span := otel.Tracer(otelName).Start(context, "createUuidsTable")
-	defer span.End()
-
-	r, err := createBaseUuidsTable(ctx, log, prefix, tx)
-	if err != nil {
-		return 0, err
-	}
-
-	_, err = tx.CreateTemporaryTable(ctx, "object_uuids", "SELECT map.object_id as object_id, meta.id FROM r_objt_metamap map JOIN base_object_uuids meta ON map.meta_id = meta.meta_id")
-	if err != nil {
-		return 0, err
-	}
-
-	return r, nil
+// createObjectUuidsTable maps the UUIDs in base_object_uuids onto their ICAT object IDs
+func createObjectUuidsTable(ctx context.Context, tx *ICATTx) error {
+	_, err := tx.CreateTemporaryTable(ctx, "object_uuids", "SELECT map.object_id as object_id, meta.id FROM r_objt_metamap map JOIN base_object_uuids meta ON map.meta_id = meta.meta_id")
+	return err
 }
 
 func createPermsTable(context context.Context, log *logrus.Entry, tx *ICATTx) error {
@@ -126,40 +133,46 @@ func createMetadataTable(context context.Context, log *logrus.Entry, tx *ICATTx)
 	return nil
 }
 
-func getSearchResults(context context.Context, log *logrus.Entry, prefix string, es *ESConnection) (int64, map[string]ElasticsearchDocument, map[string]string, error) {
+func getSearchResults(context context.Context, log *logrus.Entry, prefix string, es searchSink) (int64, map[string]ElasticsearchDocument, map[string]string, error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "getSearchResults")
 	defer span.End()
 
 	esDocs := make(map[string]ElasticsearchDocument)
 	esDocTypes := make(map[string]string)
 
-	prefixQuery := elastic.NewBoolQuery().
-		MinimumNumberShouldMatch(1).
-		Must(elastic.NewBoolQuery().
-			Should(elastic.NewTermQuery("doc_type", "file"),
-				elastic.NewTermQuery("doc_type", "folder"))).
-		Should(elastic.NewPrefixQuery("id", strings.ToUpper(prefix)),
-			elastic.NewPrefixQuery("id", strings.ToLower(prefix)))
-
-	searchService := es.es.Search(es.index).Query(prefixQuery).Sort("id", true).Size(maxInPrefix)
-	search, err := searchService.Do(ctx)
-	if err != nil {
-		return 0, nil, nil, err
-	}
+	prefixQuery := searchQuery{"bool": map[string]interface{}{
+		"minimum_should_match": 1,
+		"must":                 docTypesQuery("file", "folder"),
+		"should": []interface{}{
+			map[string]interface{}{"prefix": map[string]interface{}{"id": strings.ToUpper(prefix)}},
+			map[string]interface{}{"prefix": map[string]interface{}{"id": strings.ToLower(prefix)}},
+		},
+	}}
+
+	var total int64
+	err := es.SearchAll(ctx, prefixQuery, documentFields, func(t int64, hits []searchHit) error {
+		total = t
+		if total > int64(maxInPrefix) {
+			return ErrTooManyResults
+		}
+		addDocuments(hits, esDocs, esDocTypes)
+		return nil
+	})
 
-	log.Debugf("Got %d documents for prefix %s (ES)", search.TotalHits(), prefix)
+	log.Debugf("Got %d documents for prefix %s (ES)", total, prefix)
 
-	if search.TotalHits() > int64(maxInPrefix) {
-		return search.TotalHits(), nil, nil, ErrTooManyResults
+	if err != nil {
+		return total, nil, nil, err
 	}
+	return total, esDocs, esDocTypes, nil
+}
 
-	for _, hit := range search.Hits.Hits {
+// addDocuments decodes search hits into esDocs and esDocTypes
+func addDocuments(hits []searchHit, esDocs map[string]ElasticsearchDocument, esDocTypes map[string]string) {
+	progress.beat()
+	for _, hit := range hits {
 		var doc ElasticsearchDocument
-
-		// json.RawMessage's MarshalJSON can't actually throw an error,
-		// it's just matching a function signature
-		b, _ := hit.Source.MarshalJSON()
-		err := json.Unmarshal(b, &doc)
+		err := json.Unmarshal(hit.Source, &doc)
 		if err != nil {
 			// if it can't unmarshal the elasticsearch response,
 			// may as well just let it reindex the thing as though
@@ -167,29 +180,67 @@ func getSearchResults(context context.Context, log *logrus.Entry, prefix string,
 			continue
 		}
 
-		esDocs[hit.Id] = doc
-		esDocTypes[hit.Id] = hit.Type
+		esDocs[hit.ID] = doc
+		esDocTypes[hit.ID] = doc.DocType
 	}
-	return search.TotalHits(), esDocs, esDocTypes, nil
 }
 
-func classify(id string, doc ElasticsearchDocument, esDocs map[string]ElasticsearchDocument) DocumentClassification {
+// getDocumentsByID fetches the file and folder documents with the given IDs from ES, in batches of at most maxInPrefix
+func getDocumentsByID(context context.Context, log *logrus.Entry, ids []string, es searchSink) (int64, map[string]ElasticsearchDocument, map[string]string, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "getDocumentsByID")
+	defer span.End()
+
+	esDocs := make(map[string]ElasticsearchDocument)
+	esDocTypes := make(map[string]string)
+
+	var total int64
+	for start := 0; start < len(ids); start += maxInPrefix {
+		end := min(start+maxInPrefix, len(ids))
+		batch := ids[start:end]
+
+		query := searchQuery{"bool": map[string]interface{}{
+			"must":   map[string]interface{}{"ids": map[string]interface{}{"values": batch}},
+			"filter": docTypesQuery("file", "folder"),
+		}}
+
+		var batchTotal int64
+		err := es.SearchAll(ctx, query, documentFields, func(t int64, hits []searchHit) error {
+			batchTotal = t
+			addDocuments(hits, esDocs, esDocTypes)
+			return nil
+		})
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		total += batchTotal
+	}
+
+	log.Debugf("Got %d documents for %d IDs (ES)", total, len(ids))
+	return total, esDocs, esDocTypes, nil
+}
+
+// classify decides what to do with a document, returning the fields that differ from the indexed copy for updates
+func classify(id string, doc ElasticsearchDocument, esDocs map[string]ElasticsearchDocument) (DocumentClassification, []string) {
 	_, ok := esDocs[id]
 	if !ok {
-		return IndexDocument
+		return IndexDocument, nil
 	}
 
-	if !doc.Equal(esDocs[id]) {
-		return UpdateDocument
+	if diff := doc.Diff(esDocs[id]); len(diff) > 0 {
+		return UpdateDocument, diff
 	}
 
-	return NoAction
+	return NoAction, nil
 }
 
-func index(indexer *esutils.BulkIndexer, index, id, json string) error {
-	req := elastic.NewBulkIndexRequest().Index(index).Id(id).Doc(json)
-	// No need to check this error since we're returning
-	return indexer.Add(req)
+// countUpdatedFields adds the fields from a diff to the per-field update counters
+func (rows *rowMetadata) countUpdatedFields(fields []string) {
+	if rows.updatedFields == nil {
+		rows.updatedFields = make(map[string]int64)
+	}
+	for _, field := range fields {
+		rows.updatedFields[field]++
+	}
 }
 
 // preprocessMetadata takes in the sql.Rows from the DE database and turns it into a map.
@@ -207,16 +258,17 @@ func preprocessMetadata(rows *sql.Rows) (map[string]string, error) {
 	return ret, nil
 }
 
-func processDataobjects(context context.Context, log *logrus.Entry, rows *rowMetadata, avus map[string]string, esDocs map[string]ElasticsearchDocument, seenEsDocs map[string]bool, indexer *esutils.BulkIndexer, es *ESConnection, tx *ICATTx, irodsZone string) error {
+func processDataobjects(context context.Context, log *logrus.Entry, rows *rowMetadata, avus map[string]string, esDocs map[string]ElasticsearchDocument, seenEsDocs map[string]bool, indexer bulkIndexer, sel objectSelection, irodsZone string) error {
 	ctx, span := otel.Tracer(otelName).Start(context, "processDataobjects")
 	defer span.End()
 
-	dataobjects, err := tx.GetDataObjects(ctx, "object_uuids", "object_perms", "object_metadata", irodsZone)
+	dataobjects, err := sel.DataObjects(ctx, irodsZone)
 	if err != nil {
 		return err
 	}
 	defer logIfErr(dataobjects.Close, "closing data-objects rows")
 	for dataobjects.Next() {
+		progress.beat()
 		var id, selectedJSON string
 		if err = dataobjects.Scan(&id, &selectedJSON); err != nil {
 			return err
@@ -224,7 +276,6 @@ func processDataobjects(context context.Context, log *logrus.Entry, rows *rowMet
 
 		seenEsDocs[id] = true
 		var doc ElasticsearchDocument
-		var classification DocumentClassification
 		err := json.Unmarshal([]byte(selectedJSON), &doc)
 		if err != nil {
 			return err
@@ -242,16 +293,18 @@ func processDataobjects(context context.Context, log *logrus.Entry, rows *rowMet
 			log.Debugf("Integrated CyVerse metadata: %+v", doc)
 		}
 
-		classification = classify(id, doc, esDocs)
+		classification, diff := classify(id, doc, esDocs)
 
 		switch classification {
 		case UpdateDocument:
-			log.Debugf("data-object %s, documents differ, indexing", id)
+			log.Debugf("data-object %s, documents differ in %v, indexing", id, diff)
 			rows.dataobjectsUpdated++
+			rows.countUpdatedFields(diff)
 		case IndexDocument:
 			log.Debugf("data-object %s not in ES, indexing", id)
 			rows.dataobjectsAdded++
 		}
+		rows.plan(id, "file", classification, diff)
 
 		if classification == UpdateDocument || classification == IndexDocument {
 			reencode, err := json.Marshal(doc)
@@ -260,7 +313,7 @@ func processDataobjects(context context.Context, log *logrus.Entry, rows *rowMet
 			}
 			processedJSON := string(reencode)
 
-			if err = index(indexer, es.index, id, processedJSON); err != nil {
+			if err = indexer.Index(id, processedJSON); err != nil {
 				return err
 			}
 		}
@@ -270,19 +323,20 @@ func processDataobjects(context context.Context, log *logrus.Entry, rows *rowMet
 	}
 
 	log.Debugf("%d data-objects missing, %d data-objects to update", rows.dataobjectsAdded, rows.dataobjectsUpdated)
-	return nil
+	return dataobjects.Err()
 }
 
-func processCollections(context context.Context, log *logrus.Entry, rows *rowMetadata, avus map[string]string, esDocs map[string]ElasticsearchDocument, seenEsDocs map[string]bool, indexer *esutils.BulkIndexer, es *ESConnection, tx *ICATTx, irodsZone string) error {
+func processCollections(context context.Context, log *logrus.Entry, rows *rowMetadata, avus map[string]string, esDocs map[string]ElasticsearchDocument, seenEsDocs map[string]bool, indexer bulkIndexer, sel objectSelection, irodsZone string) error {
 	ctx, span := otel.Tracer(otelName).Start(context, "processCollections")
 	defer span.End()
 
-	colls, err := tx.GetCollections(ctx, "object_uuids", "object_perms", "object_metadata", irodsZone)
+	colls, err := sel.Collections(ctx, irodsZone)
 	if err != nil {
 		return err
 	}
 	defer logIfErr(colls.Close, "closing collections rows")
 	for colls.Next() {
+		progress.beat()
 		var id, selectedJSON string
 		if err = colls.Scan(&id, &selectedJSON); err != nil {
 			return err
@@ -290,14 +344,11 @@ func processCollections(context context.Context, log *logrus.Entry, rows *rowMet
 
 		seenEsDocs[id] = true
 		var doc ElasticsearchDocument
-		var classification DocumentClassification
 		err := json.Unmarshal([]byte(selectedJSON), &doc)
 		if err != nil {
 			return err
 		}
 
-		classification = classify(id, doc, esDocs)
-
 		_, ok := avus[id]
 		if ok {
 			var cymeta CyverseMetadata
@@ -310,14 +361,18 @@ func processCollections(context context.Context, log *logrus.Entry, rows *rowMet
 			log.Debugf("Integrated CyVerse metadata: %+v", doc)
 		}
 
+		classification, diff := classify(id, doc, esDocs)
+
 		switch classification {
 		case UpdateDocument:
-			log.Debugf("data-object %s, documents differ, indexing", id)
+			log.Debugf("collection %s, documents differ in %v, indexing", id, diff)
 			rows.collsUpdated++
+			rows.countUpdatedFields(diff)
 		case IndexDocument:
-			log.Debugf("data-object %s not in ES, indexing", id)
+			log.Debugf("collection %s not in ES, indexing", id)
 			rows.collsAdded++
 		}
+		rows.plan(id, "folder", classification, diff)
 
 		if classification == UpdateDocument || classification == IndexDocument {
 			reencode, err := json.Marshal(doc)
@@ -326,7 +381,7 @@ func processCollections(context context.Context, log *logrus.Entry, rows *rowMet
 			}
 			processedJSON := string(reencode)
 
-			if err = index(indexer, es.index, id, processedJSON); err != nil {
+			if err = indexer.Index(id, processedJSON); err != nil {
 				return err
 			}
 		}
@@ -336,10 +391,10 @@ func processCollections(context context.Context, log *logrus.Entry, rows *rowMet
 	}
 
 	log.Debugf("%d collections missing, %d collections to update", rows.collsAdded, rows.collsUpdated)
-	return nil
+	return colls.Err()
 }
 
-func processDeletions(context context.Context, log *logrus.Entry, rows *rowMetadata, esDocs map[string]ElasticsearchDocument, esDocTypes map[string]string, seenEsDocs map[string]bool, indexer *esutils.BulkIndexer, es *ESConnection) error {
+func processDeletions(context context.Context, log *logrus.Entry, rows *rowMetadata, esDocs map[string]ElasticsearchDocument, esDocTypes map[string]string, seenEsDocs map[string]bool, indexer bulkIndexer) error {
 	//ctx, span := otel.Tracer(otelName).Start(context, "processDeletions")
 	_, span := otel.Tracer(otelName).Start(context, "processDeletions")
 	defer span.End()
@@ -359,8 +414,8 @@ func processDeletions(context context.Context, log *logrus.Entry, rows *rowMetad
 				log.Debugf("collection %s not seen in ICAT, deleting", id)
 				rows.collsRemoved++
 			}
-			req := elastic.NewBulkDeleteRequest().Index(es.index).Id(id)
-			err := indexer.Add(req)
+			rows.planDelete(id, docType)
+			err := indexer.Delete(id)
 			if err != nil {
 				return errors.Wrap(err, "Got error adding delete to indexer")
 			}
@@ -371,13 +426,26 @@ func processDeletions(context context.Context, log *logrus.Entry, rows *rowMetad
 	return nil
 }
 
-// ReindexPrefix attempts to reindex a given prefix given a DB and ES connection
-func ReindexPrefix(context context.Context, icat *ICATConnection, dedb *DEDBConnection, es *ESConnection, prefix, irodsZone string) error {
+// ReindexPrefix attempts to reindex a given prefix given an object source, metadata source and search sink, returning counts of what it did
+func ReindexPrefix(context context.Context, icat objectSource, dedb metadataSource, es searchSink, prefix, irodsZone string, opts ReindexOptions) (rowMetadata, error) {
+	var rows rowMetadata
+	err := reindexPrefix(context, icat, dedb, es, prefix, irodsZone, opts, &rows)
+	return rows, err
+}
+
+func reindexPrefix(context context.Context, icat objectSource, dedb metadataSource, es searchSink, prefix, irodsZone string, opts ReindexOptions, rows *rowMetadata) (err error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "ReindexPrefix")
 	defer span.End()
 
+	// prefixes end up in LIKE patterns, so nothing but hex digits is allowed
+	if !isHexPrefix(prefix) {
+		return errors.Errorf("Invalid prefix %q", prefix)
+	}
+
 	// SETUP
-	var rows rowMetadata
+	if opts.DryRun {
+		rows.report = newDryRunReport("prefix", prefix)
+	}
 
 	prefixlog := log.WithFields(logrus.Fields{
 		"prefix": prefix,
@@ -385,7 +453,8 @@ func ReindexPrefix(context context.Context, icat *ICATConnection, dedb *DEDBConn
 	prefixlog.Debugf("Indexing prefix %s", prefix)
 
 	start := time.Now()
-	defer logTime(prefixlog, start, &rows)
+	defer logTime(prefixlog, start, rows)
+	defer func() { observeReindex("prefix", start, rows, err) }()
 
 	seenEsDocs := make(map[string]bool)
 	docs, esDocs, esDocTypes, err := getSearchResults(ctx, prefixlog, prefix, es)
@@ -394,30 +463,138 @@ func ReindexPrefix(context context.Context, icat *ICATConnection, dedb *DEDBConn
 		return err
 	}
 
-	deTx, err := dedb.BeginTx(ctx, nil)
+	avus, err := dedb.PrefixAVUs(ctx, prefix)
 	if err != nil {
 		return err
 	}
-	deRollback := func() {
-		err := deTx.tx.Rollback()
-		if err != nil && err.Error() != "sql: transaction has already been committed or rolled back" {
-			prefixlog.Debugf("Failed rolling back DE transaction: %s", err.Error())
-		}
-	}
-	defer deRollback()
 
-	avusRows, err := deTx.GetAVUs(ctx, prefix)
+	// COLLECT PREREQUISITES
+	sel, r, err := icat.SelectPrefix(ctx, prefixlog, prefix)
+	rows.rows = r
 	if err != nil {
 		return err
 	}
-	defer logIfErr(avusRows.Close, "closing AVUs rows (deferred)")
+	defer sel.Close()
 
-	avus, err := preprocessMetadata(avusRows)
-	if err != nil {
+	if r > int64(maxInPrefix) {
+		return ErrTooManyResults
+	}
+
+	if err = sel.Prepare(ctx, prefixlog); err != nil {
 		return err
 	}
-	logIfErr(avusRows.Close, "closing AVUs rows")
-	deRollback()
+
+	// PROCESS
+	indexer := newIndexer(ctx, es, opts)
+	defer logIfErr(func() error { return flushIfPending(indexer) }, "flushing bulk indexer (deferred)")
+
+	if err = processDataobjects(ctx, prefixlog, rows, avus, esDocs, seenEsDocs, indexer, sel, irodsZone); err != nil {
+		return err
+	}
+
+	if err = processCollections(ctx, prefixlog, rows, avus, esDocs, seenEsDocs, indexer, sel, irodsZone); err != nil {
+		return err
+	}
+
+	// Release the selection as early as possible
+	sel.Close()
+
+	if err = processDeletions(ctx, prefixlog, rows, esDocs, esDocTypes, seenEsDocs, indexer); err != nil {
+		return err
+	}
+
+	// FINISH UP
+	if err = flushIfPending(indexer); err != nil {
+		return errors.Wrap(err, "Got error flushing bulk indexer")
+	}
+
+	return rows.report.emit()
+}
+
+// baseUuidsCreator fills the base_object_uuids temporary table with the objects a reindex should consider
+type baseUuidsCreator func(ctx context.Context, log *logrus.Entry, tx *ICATTx) (int64, error)
+
+// idsUuids selects the objects with the given lowercase UUIDs
+func idsUuids(ids []string) baseUuidsCreator {
+	return func(ctx context.Context, log *logrus.Entry, tx *ICATTx) (int64, error) {
+		return tx.CreateTemporaryTable(ctx, "base_object_uuids", "SELECT meta.meta_id, lower(meta.meta_attr_value) as id FROM r_meta_main meta WHERE meta.meta_attr_name = 'ipc_UUID' AND meta.meta_attr_value = ANY($1)", pq.Array(uuidCaseVariants(ids)))
+	}
+}
+
+// selectionBatch is part of a selection which is too large to reindex at once
+type selectionBatch struct {
+	ids        []string
+	candidates []string
+}
+
+// batchSelection splits the selected IDs and the deletion candidates into batches of at most size
+// distinct IDs, in ID order. A selection which fits in one batch is returned as is.
+func batchSelection(ids, candidates []string, size int) []selectionBatch {
+	isCandidate := make(map[string]bool, len(candidates))
+	all := make(map[string]bool, len(ids)+len(candidates))
+	for _, id := range ids {
+		all[id] = true
+	}
+	for _, id := range candidates {
+		isCandidate[id] = true
+		all[id] = true
+	}
+	if len(all) <= size {
+		return []selectionBatch{{ids: ids, candidates: candidates}}
+	}
+
+	selected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+	sorted := make([]string, 0, len(all))
+	for id := range all {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	var batches []selectionBatch
+	for len(sorted) > 0 {
+		n := min(size, len(sorted))
+		var b selectionBatch
+		for _, id := range sorted[:n] {
+			if selected[id] {
+				b.ids = append(b.ids, id)
+			}
+			if isCandidate[id] {
+				b.candidates = append(b.candidates, id)
+			}
+		}
+		batches = append(batches, b)
+		sorted = sorted[n:]
+	}
+	return batches
+}
+
+// reindexSelected reindexes the objects selected by createBase. Unlike ReindexPrefix, the
+// ICAT is consulted first and only the matching documents are fetched from ES. Any ID in
+// candidates that is present in ES but was not seen in the ICAT is deleted; other documents
+// are never deleted since the selection can't say whether they still exist. Selections of
+// more than maxInPrefix objects are split into batches.
+func reindexSelected(context context.Context, log *logrus.Entry, icat *ICATConnection, dedb *DEDBConnection, es SearchBackend, createBase baseUuidsCreator, candidates []string, irodsZone string, scope, target string, opts ReindexOptions) (err error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "reindexSelected")
+	defer span.End()
+
+	// SETUP
+	var rows rowMetadata
+	if opts.DryRun {
+		rows.report = newDryRunReport(scope, target)
+	}
+
+	start := time.Now()
+	batched := false
+	defer func() {
+		// each batch records its own progress
+		if !batched {
+			logTime(log, start, &rows)
+			observeReindex(scope, start, &rows, err)
+		}
+	}()
 
 	icatTx, err := icat.BeginTx(ctx, nil)
 	if err != nil {
@@ -426,52 +603,119 @@ func ReindexPrefix(context context.Context, icat *ICATConnection, dedb *DEDBConn
 	icatRollback := func() {
 		err := icatTx.tx.Rollback()
 		if err != nil && err.Error() != "sql: transaction has already been committed or rolled back" {
-			prefixlog.Debugf("Failed rolling back ICAT transaction: %s", err.Error())
+			log.Debugf("Failed rolling back ICAT transaction: %s", err.Error())
 		}
 	}
 	defer icatRollback()
 
 	// COLLECT PREREQUISITES
-	r, err := createUuidsTable(ctx, prefixlog, prefix, icatTx)
+	r, err := createBase(ctx, log, icatTx)
 	rows.rows = r
 	if err != nil {
 		return err
 	}
 
-	if err = createPermsTable(ctx, prefixlog, icatTx); err != nil {
+	if err = createObjectUuidsTable(ctx, icatTx); err != nil {
 		return err
 	}
 
-	if err = createMetadataTable(ctx, prefixlog, icatTx); err != nil {
+	ids, err := icatTx.GetObjectIDs(ctx, "object_uuids")
+	if err != nil {
+		return err
+	}
+
+	// Too many objects to hold at once are reindexed in batches, each in its own transaction
+	if batches := batchSelection(ids, candidates, maxInPrefix); len(batches) > 1 {
+		icatRollback()
+		batched = true
+		log.Infof("Selected %d objects, reindexing in %d batches", len(ids), len(batches))
+		for _, b := range batches {
+			err = reindexSelected(ctx, log, icat, dedb, es, idsUuids(b.ids), b.candidates, irodsZone, scope, target, opts)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(ids) == 0 && len(candidates) == 0 {
+		log.Debug("No objects selected, nothing to do")
+		return rows.report.emit()
+	}
+
+	docs, esDocs, esDocTypes, err := getDocumentsByID(ctx, log, append(ids, candidates...), es)
+	rows.documents = docs
+	if err != nil {
+		return err
+	}
+
+	deTx, err := dedb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	deRollback := func() {
+		err := deTx.tx.Rollback()
+		if err != nil && err.Error() != "sql: transaction has already been committed or rolled back" {
+			log.Debugf("Failed rolling back DE transaction: %s", err.Error())
+		}
+	}
+	defer deRollback()
+
+	avusRows, err := deTx.GetAVUsForIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	defer logIfErr(avusRows.Close, "closing AVUs rows (deferred)")
+
+	avus, err := preprocessMetadata(avusRows)
+	if err != nil {
+		return err
+	}
+	logIfErr(avusRows.Close, "closing AVUs rows")
+	deRollback()
+
+	if err = createPermsTable(ctx, log, icatTx); err != nil {
+		return err
+	}
+
+	if err = createMetadataTable(ctx, log, icatTx); err != nil {
 		return err
 	}
 
 	// PROCESS
-	indexer := es.NewBulkIndexer(ctx, 1000)
-	defer logIfErr(indexer.Flush, "flushing bulk indexer (deferred)")
+	seenEsDocs := make(map[string]bool)
+
+	sel := &icatSelection{tx: icatTx, log: log}
 
-	if err = processDataobjects(ctx, prefixlog, &rows, avus, esDocs, seenEsDocs, indexer, es, icatTx, irodsZone); err != nil {
+	indexer := newIndexer(ctx, es, opts)
+	defer logIfErr(func() error { return flushIfPending(indexer) }, "flushing bulk indexer (deferred)")
+
+	if err = processDataobjects(ctx, log, &rows, avus, esDocs, seenEsDocs, indexer, sel, irodsZone); err != nil {
 		return err
 	}
 
-	if err = processCollections(ctx, prefixlog, &rows, avus, esDocs, seenEsDocs, indexer, es, icatTx, irodsZone); err != nil {
+	if err = processCollections(ctx, log, &rows, avus, esDocs, seenEsDocs, indexer, sel, irodsZone); err != nil {
 		return err
 	}
 
-	// Roll back transactions as early as possible
 	icatRollback()
 
-	if err = processDeletions(ctx, prefixlog, &rows, esDocs, esDocTypes, seenEsDocs, indexer, es); err != nil {
+	// Only documents named as candidates are eligible for deletion
+	candidateDocs := make(map[string]ElasticsearchDocument)
+	for _, id := range candidates {
+		if doc, ok := esDocs[id]; ok {
+			candidateDocs[id] = doc
+		}
+	}
+
+	if err = processDeletions(ctx, log, &rows, candidateDocs, esDocTypes, seenEsDocs, indexer); err != nil {
 		return err
 	}
 
 	// FINISH UP
-	if indexer.CanFlush() {
-		err = indexer.Flush()
-		if err != nil {
-			return errors.Wrap(err, "Got error flushing bulk indexer")
-		}
+	if err = flushIfPending(indexer); err != nil {
+		return errors.Wrap(err, "Got error flushing bulk indexer")
 	}
 
-	return nil
+	return rows.report.emit()
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func fileDoc(id string, modified int64) ElasticsearchDocument {
+	return ElasticsearchDocument{DocType: "file", ID: id, Path: "/iplant/home/ipcdev/" + id, Label: id, Creator: "ipcdev#iplant", DateCreated: 1000, DateModified: modified, FileSize: 10}
+}
+
+func folderDoc(id string, modified int64) ElasticsearchDocument {
+	return ElasticsearchDocument{DocType: "folder", ID: id, Path: "/iplant/home/" + id, Label: id, Creator: "ipcdev#iplant", DateCreated: 1000, DateModified: modified}
+}
+
+func withCyverse(doc ElasticsearchDocument, md ...Metadatum) ElasticsearchDocument {
+	doc.Metadata.Cyverse = md
+	return doc
+}
+
+// useTestSettings sets the globals a reindex reads for the length of a test
+func useTestSettings(t *testing.T, max int) {
+	oldMax, oldOutput := maxInPrefix, dryRunOutput
+	maxInPrefix, dryRunOutput = max, io.Discard
+	t.Cleanup(func() { maxInPrefix, dryRunOutput = oldMax, oldOutput })
+}
+
+// counts is the added, updated and removed counts for data objects and then collections
+type counts [6]int64
+
+func TestReindexPrefix(t *testing.T) {
+	md := Metadatum{Attribute: "color", Value: "blue", Unit: ""}
+
+	cases := []struct {
+		name     string
+		icat     []ElasticsearchDocument
+		avus     map[string][]Metadatum
+		indexed  []ElasticsearchDocument
+		max      int
+		dryRun   bool
+		expected []ElasticsearchDocument
+		counts   counts
+		writes   int
+		err      error
+	}{
+		{
+			name:     "add",
+			icat:     []ElasticsearchDocument{fileDoc("ab01", 1), folderDoc("ab02", 1)},
+			max:      10,
+			expected: []ElasticsearchDocument{fileDoc("ab01", 1), folderDoc("ab02", 1)},
+			counts:   counts{1, 0, 0, 1, 0, 0},
+			writes:   2,
+		},
+		{
+			name:     "unchanged",
+			icat:     []ElasticsearchDocument{fileDoc("ab01", 1), folderDoc("ab02", 1)},
+			indexed:  []ElasticsearchDocument{fileDoc("ab01", 1), folderDoc("ab02", 1)},
+			max:      10,
+			expected: []ElasticsearchDocument{fileDoc("ab01", 1), folderDoc("ab02", 1)},
+		},
+		{
+			name:     "update",
+			icat:     []ElasticsearchDocument{fileDoc("ab01", 2), folderDoc("ab02", 2)},
+			indexed:  []ElasticsearchDocument{fileDoc("ab01", 1), folderDoc("ab02", 2)},
+			max:      10,
+			expected: []ElasticsearchDocument{fileDoc("ab01", 2), folderDoc("ab02", 2)},
+			counts:   counts{0, 1, 0, 0, 0, 0},
+			writes:   1,
+		},
+		{
+			name:     "cyverse metadata",
+			icat:     []ElasticsearchDocument{fileDoc("ab01", 1)},
+			avus:     map[string][]Metadatum{"ab01": {md}, "cd01": {md}},
+			indexed:  []ElasticsearchDocument{fileDoc("ab01", 1)},
+			max:      10,
+			expected: []ElasticsearchDocument{withCyverse(fileDoc("ab01", 1), md)},
+			counts:   counts{0, 1, 0, 0, 0, 0},
+			writes:   1,
+		},
+		{
+			name:     "delete",
+			indexed:  []ElasticsearchDocument{fileDoc("ab01", 1), folderDoc("ab02", 1), fileDoc("cd01", 1)},
+			max:      10,
+			expected: []ElasticsearchDocument{fileDoc("cd01", 1)},
+			counts:   counts{0, 0, 1, 0, 0, 1},
+			writes:   2,
+		},
+		{
+			name:     "outside prefix",
+			icat:     []ElasticsearchDocument{fileDoc("ab01", 1), fileDoc("cd01", 2)},
+			indexed:  []ElasticsearchDocument{fileDoc("cd01", 1)},
+			max:      10,
+			expected: []ElasticsearchDocument{fileDoc("ab01", 1), fileDoc("cd01", 1)},
+			counts:   counts{1, 0, 0, 0, 0, 0},
+			writes:   1,
+		},
+		{
+			name:     "split on ICAT rows",
+			icat:     []ElasticsearchDocument{fileDoc("ab01", 1), fileDoc("ab02", 1)},
+			max:      1,
+			expected: nil,
+			err:      ErrTooManyResults,
+		},
+		{
+			name:     "split on indexed documents",
+			indexed:  []ElasticsearchDocument{fileDoc("ab01", 1), fileDoc("ab02", 1)},
+			max:      1,
+			expected: []ElasticsearchDocument{fileDoc("ab01", 1), fileDoc("ab02", 1)},
+			err:      ErrTooManyResults,
+		},
+		{
+			name:     "dry run",
+			icat:     []ElasticsearchDocument{fileDoc("ab01", 2), folderDoc("ab02", 1)},
+			indexed:  []ElasticsearchDocument{fileDoc("ab01", 1), fileDoc("ab03", 1)},
+			max:      10,
+			dryRun:   true,
+			expected: []ElasticsearchDocument{fileDoc("ab01", 1), fileDoc("ab03", 1)},
+			counts:   counts{0, 1, 1, 1, 0, 0},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useTestSettings(t, c.max)
+
+			icat := fakeObjects{}
+			for _, doc := range c.icat {
+				icat[doc.ID] = doc
+			}
+			indexed := make([]interface{}, len(c.indexed))
+			for i, doc := range c.indexed {
+				indexed[i] = doc
+			}
+			es, err := newFakeSearch(indexed...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rows, err := ReindexPrefix(context.Background(), icat, fakeMetadata{avus: c.avus}, es, "ab", "iplant", ReindexOptions{DryRun: c.dryRun})
+			if err != c.err {
+				t.Fatalf("Got error %v, expected %v", err, c.err)
+			}
+
+			got := counts{rows.dataobjectsAdded, rows.dataobjectsUpdated, rows.dataobjectsRemoved, rows.collsAdded, rows.collsUpdated, rows.collsRemoved}
+			if got != c.counts {
+				t.Errorf("Got counts %v, expected %v", got, c.counts)
+			}
+			if es.writes != c.writes {
+				t.Errorf("Got %d writes, expected %d", es.writes, c.writes)
+			}
+
+			if len(es.docs) != len(c.expected) {
+				t.Errorf("Got %d documents, expected %d", len(es.docs), len(c.expected))
+			}
+			for _, expected := range c.expected {
+				source, ok := es.docs[expected.ID]
+				if !ok {
+					t.Errorf("Document %s is missing", expected.ID)
+					continue
+				}
+				var doc ElasticsearchDocument
+				if err = json.Unmarshal(source, &doc); err != nil {
+					t.Fatal(err)
+				}
+				if diff := expected.Diff(doc); len(diff) > 0 {
+					t.Errorf("Document %s differs in %v", expected.ID, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestReindexPrefixRejectsInvalidPrefix(t *testing.T) {
+	useTestSettings(t, 10)
+
+	for _, prefix := range []string{"", "zz", "ab'", "ab%", "ab_"} {
+		es, err := newFakeSearch(fileDoc("ab01", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		icat := fakeObjects{"ab01": fileDoc("ab01", 1)}
+
+		if _, err = ReindexPrefix(context.Background(), icat, fakeMetadata{}, es, prefix, "iplant", ReindexOptions{}); err == nil {
+			t.Errorf("%q: expected an error", prefix)
+		}
+		// an empty prefix means all AVUs, so it's only refused when reindexing
+		if prefix == "" {
+			continue
+		}
+		if _, err = (&DEDBTx{}).GetAVUs(context.Background(), prefix); err == nil {
+			t.Errorf("%q: expected an error fetching AVUs", prefix)
+		}
+	}
+}
+
+func TestBatchSelection(t *testing.T) {
+	cases := []struct {
+		name       string
+		ids        []string
+		candidates []string
+		size       int
+		expected   []selectionBatch
+	}{
+		{
+			name:     "fits",
+			ids:      []string{"b", "a"},
+			size:     2,
+			expected: []selectionBatch{{ids: []string{"b", "a"}}},
+		},
+		{
+			name:       "overlapping candidates fit",
+			ids:        []string{"a", "b"},
+			candidates: []string{"b"},
+			size:       2,
+			expected:   []selectionBatch{{ids: []string{"a", "b"}, candidates: []string{"b"}}},
+		},
+		{
+			name:       "split",
+			ids:        []string{"e", "a", "c", "b"},
+			candidates: []string{"d", "c"},
+			size:       2,
+			expected: []selectionBatch{
+				{ids: []string{"a", "b"}},
+				{ids: []string{"c"}, candidates: []string{"c", "d"}},
+				{ids: []string{"e"}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := batchSelection(c.ids, c.candidates, c.size)
+			if len(got) != len(c.expected) {
+				t.Fatalf("Got %d batches, expected %d: %v", len(got), len(c.expected), got)
+			}
+			for i := range got {
+				if strings.Join(got[i].ids, ",") != strings.Join(c.expected[i].ids, ",") ||
+					strings.Join(got[i].candidates, ",") != strings.Join(c.expected[i].candidates, ",") {
+					t.Errorf("Batch %d: got %v, expected %v", i, got[i], c.expected[i])
+				}
+			}
+		})
+	}
+}
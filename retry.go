@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// retryExchange is the headers exchange failed messages are published to while they wait to be retried
+const retryExchange = "infosquito2.retry"
+
+// retryQueueHeader names the delay queue a retried message is routed to by the retry exchange
+const retryQueueHeader = "x-infosquito2-retry-queue"
+
+// attemptHeader counts how many times handling a retried message has already failed
+const attemptHeader = "x-infosquito2-attempt"
+
+// delayer holds a message on the broker for delay before republishing it with routingKey and the attempt header set
+type delayer interface {
+	delay(ctx context.Context, routingKey string, body []byte, attempt int, delay time.Duration) error
+}
+
+// deliveryAttempts returns how many times handling a delivery has already failed, which is 0 unless it's a retry
+func deliveryAttempts(del amqp.Delivery) int {
+	switch n := del.Headers[attemptHeader].(type) {
+	case int8:
+		return int(n)
+	case int16:
+		return int(n)
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// retrier handles messages which failed, republishing them after an exponential backoff and
+// dead-lettering them once they've been tried too many times
+type retrier struct {
+	delays     delayer
+	deadLetter *deadLetterQueue
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+func newRetrier(delays delayer, deadLetter *deadLetterQueue, maxRetries int, baseDelay, maxDelay time.Duration) *retrier {
+	return &retrier{
+		delays:     delays,
+		deadLetter: deadLetter,
+		maxRetries: maxRetries,
+		baseDelay:  baseDelay,
+		maxDelay:   maxDelay,
+	}
+}
+
+// backoff returns how long to wait before the given attempt (starting at 1)
+func (r *retrier) backoff(attempt int) time.Duration {
+	delay := r.baseDelay
+	for i := 1; i < attempt && delay < r.maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, r.maxDelay)
+}
+
+// fail deals with a message whose handling failed with cause. The delivery is only acknowledged once the
+// broker has accepted the retry or dead letter; if neither is possible it's rejected and requeued so it
+// isn't lost. cause is always returned so the caller knows not to acknowledge the delivery itself.
+func (r *retrier) fail(ctx context.Context, del amqp.Delivery, cause error) error {
+	handlerFailuresTotal.WithLabelValues(messageKind(del.RoutingKey)).Inc()
+	attempt := deliveryAttempts(del) + 1
+
+	if attempt > r.maxRetries {
+		if err := r.deadLetter.publish(ctx, del, attempt, cause.Error()); err != nil {
+			log.Error(errors.Wrapf(err, "Failed dead-lettering %s", del.RoutingKey))
+			r.requeue(del)
+			return cause
+		}
+	} else {
+		delay := r.backoff(attempt)
+		if err := r.delays.delay(ctx, del.RoutingKey, del.Body, attempt, delay); err != nil {
+			log.Error(errors.Wrapf(err, "Failed scheduling retry of %s", del.RoutingKey))
+			r.requeue(del)
+			return cause
+		}
+		log.Infof("Retrying %s in %s (attempt %d of %d)", del.RoutingKey, delay, attempt, r.maxRetries)
+		retriesTotal.WithLabelValues(messageKind(del.RoutingKey)).Inc()
+	}
+
+	if err := del.Ack(false); err != nil {
+		log.Error(errors.Wrap(err, "Failed acknowledging failed message"))
+	}
+	return cause
+}
+
+// reject dead-letters a message which can never succeed (e.g. it's malformed) without retrying it
+func (r *retrier) reject(ctx context.Context, del amqp.Delivery, reason string) error {
+	if err := r.deadLetter.publish(ctx, del, 1, reason); err != nil {
+		log.Error(errors.Wrapf(err, "Failed dead-lettering %s", del.RoutingKey))
+		if rejectErr := del.Reject(false); rejectErr != nil {
+			log.Error(errors.Wrap(rejectErr, "Failed rejecting message"))
+		}
+		return errors.New(reason)
+	}
+
+	if err := del.Ack(false); err != nil {
+		log.Error(errors.Wrap(err, "Failed acknowledging dead-lettered message"))
+	}
+	return errors.New(reason)
+}
+
+// rejectUnparseable dead-letters a message whose body couldn't be read, since it will never succeed
+func (r *retrier) rejectUnparseable(ctx context.Context, del amqp.Delivery, err error) error {
+	log.Errorf("Unparseable %s message body: %s", del.RoutingKey, err)
+	return r.reject(ctx, del, fmt.Sprintf("unparseable message body: %s", err))
+}
+
+func (r *retrier) requeue(del amqp.Delivery) {
+	if err := del.Reject(true); err != nil {
+		log.Error(errors.Wrap(err, "Failed requeueing message"))
+	}
+}
+
+// delayQueues holds failed messages on the broker until they're due, so a retry survives the replica
+// which scheduled it crashing. Each distinct delay gets a queue with that message TTL, bound to the retry
+// exchange by its name in a header. Expired messages are dead-lettered back to the main exchange, keeping the
+// routing key they were published with.
+type delayQueues struct {
+	uri         string
+	exchange    string
+	queuePrefix string
+
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	declared map[time.Duration]bool
+}
+
+func newDelayQueues(uri, exchange, queuePrefix string) *delayQueues {
+	return &delayQueues{uri: uri, exchange: exchange, queuePrefix: queuePrefix}
+}
+
+func getDelayQueueName(prefix string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", getQueueName(prefix), delay)
+}
+
+// channel returns a confirming channel with the retry exchange declared, reconnecting if the last one was closed
+func (q *delayQueues) channel() (*amqp.Channel, error) {
+	if q.ch != nil && !q.ch.IsClosed() {
+		return q.ch, nil
+	}
+	if q.conn == nil || q.conn.IsClosed() {
+		conn, err := amqp.Dial(q.uri)
+		if err != nil {
+			return nil, err
+		}
+		q.conn = conn
+	}
+
+	ch, err := q.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		logIfErr(ch.Close, "closing retry channel")
+		return nil, err
+	}
+	if err = ch.ExchangeDeclare(retryExchange, amqp.ExchangeHeaders, true, false, false, false, nil); err != nil {
+		return nil, err
+	}
+	q.ch = ch
+	q.declared = make(map[time.Duration]bool)
+	return ch, nil
+}
+
+// declare makes sure the queue for delay exists and is bound to the retry exchange
+func (q *delayQueues) declare(ch *amqp.Channel, delay time.Duration) error {
+	if q.declared[delay] {
+		return nil
+	}
+	name := getDelayQueueName(q.queuePrefix, delay)
+	_, err := ch.QueueDeclare(name, true, false, false, false, amqp.Table{
+		"x-message-ttl":          delay.Milliseconds(),
+		"x-dead-letter-exchange": q.exchange,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed declaring delay queue %s", name)
+	}
+	err = ch.QueueBind(name, "", retryExchange, false, amqp.Table{"x-match": "all", retryQueueHeader: name})
+	if err != nil {
+		return errors.Wrapf(err, "Failed binding delay queue %s", name)
+	}
+	q.declared[delay] = true
+	return nil
+}
+
+// delay publishes a message to the queue for delay and waits for the broker to confirm it
+func (q *delayQueues) delay(ctx context.Context, routingKey string, body []byte, attempt int, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ch, err := q.channel()
+	if err != nil {
+		return err
+	}
+	if err = q.declare(ch, delay); err != nil {
+		return err
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, retryExchange, routingKey, false, false, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		ContentType:  "text/plain",
+		Headers: amqp.Table{
+			retryQueueHeader: getDelayQueueName(q.queuePrefix, delay),
+			attemptHeader:    int32(attempt),
+		},
+		Body: body,
+	})
+	if err != nil {
+		return err
+	}
+	ok, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("Broker refused the retry of %s", routingKey)
+	}
+	return nil
+}
+
+// Close closes the connection used for retries
+func (q *delayQueues) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.conn == nil {
+		return nil
+	}
+	return q.conn.Close()
+}
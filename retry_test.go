@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeDelayer records the retries published to it, failing them all if err is set
+type fakeDelayer struct {
+	err    error
+	events *[]string
+}
+
+func (d fakeDelayer) delay(ctx context.Context, routingKey string, body []byte, attempt int, delay time.Duration) error {
+	if d.err != nil {
+		return d.err
+	}
+	*d.events = append(*d.events, fmt.Sprintf("delay %s %s attempt %d %s", routingKey, delay, attempt, body))
+	return nil
+}
+
+// fakeAcknowledger records what was done with a delivery
+type fakeAcknowledger struct {
+	events *[]string
+}
+
+func (a fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	*a.events = append(*a.events, "ack")
+	return nil
+}
+
+func (a fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	*a.events = append(*a.events, "nack")
+	return nil
+}
+
+func (a fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	if requeue {
+		*a.events = append(*a.events, "requeue")
+	} else {
+		*a.events = append(*a.events, "reject")
+	}
+	return nil
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	r := newRetrier(nil, nil, 5, 30*time.Second, 5*time.Minute)
+
+	cases := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{50, 5 * time.Minute},
+	}
+
+	for _, c := range cases {
+		if got := r.backoff(c.attempt); got != c.expected {
+			t.Errorf("Attempt %d: got %s instead of expected %s", c.attempt, got, c.expected)
+		}
+	}
+}
+
+func TestDeliveryAttempts(t *testing.T) {
+	cases := []struct {
+		name     string
+		headers  amqp.Table
+		expected int
+	}{
+		{"first delivery", nil, 0},
+		{"retried", amqp.Table{attemptHeader: int32(3)}, 3},
+		{"decoded as a long", amqp.Table{attemptHeader: int64(4)}, 4},
+		{"not a number", amqp.Table{attemptHeader: "3"}, 0},
+	}
+
+	for _, c := range cases {
+		if got := deliveryAttempts(amqp.Delivery{Headers: c.headers}); got != c.expected {
+			t.Errorf("%s: got %d attempts instead of expected %d", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestRetrierFail(t *testing.T) {
+	cause := errors.New("ICAT unavailable")
+
+	cases := []struct {
+		name     string
+		delayErr error
+		expected []string
+	}{
+		{"retried", nil, []string{`delay index.data.prefix.abc 1m0s attempt 2 {"run_id":"r1"}`, "ack"}},
+		{"broker unavailable", errors.New("connection refused"), []string{"requeue"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var events []string
+			r := newRetrier(fakeDelayer{err: c.delayErr, events: &events}, nil, 5, 30*time.Second, 5*time.Minute)
+			del := amqp.Delivery{
+				Acknowledger: fakeAcknowledger{events: &events},
+				RoutingKey:   "index.data.prefix.abc",
+				Headers:      amqp.Table{attemptHeader: int32(1)},
+				Body:         []byte(`{"run_id":"r1"}`),
+			}
+
+			// the body is republished untouched, with the attempt in a header
+			if err := r.fail(context.Background(), del, cause); err != cause {
+				t.Errorf("Got error %v instead of the cause", err)
+			}
+			if len(events) != len(c.expected) {
+				t.Fatalf("Got events %q, expected %q", events, c.expected)
+			}
+			for i := range events {
+				if events[i] != c.expected[i] {
+					t.Errorf("Got events %q, expected %q", events, c.expected)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+-- Table for the high-water marks of infosquito2's incremental reindexes, so every replica starts from
+-- the same point. infosquito2 doesn't create it itself; apply this as a migration to the DE metadata
+-- database, in the schema named by db.schema, before running incremental reindexes.
+
+CREATE TABLE IF NOT EXISTS infosquito_high_water_marks (
+    name text PRIMARY KEY,
+    mark timestamp with time zone NOT NULL,
+    updated_on timestamp with time zone NOT NULL DEFAULT now()
+);
@@ -0,0 +1,11 @@
+-- Indexes on the ICAT's modify_ts columns for infosquito2's incremental reindexes, which select whatever
+-- changed since the high-water mark. Without them each incremental run scans these tables in full. Apply
+-- this to the ICAT database (not the DE database) before running incremental reindexes. CONCURRENTLY
+-- avoids blocking iRODS while the indexes are built, so run each statement on its own, outside a
+-- transaction.
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_infosquito2_data_modify_ts ON r_data_main (modify_ts);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_infosquito2_coll_modify_ts ON r_coll_main (modify_ts);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_infosquito2_access_modify_ts ON r_objt_access (modify_ts);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_infosquito2_metamap_modify_ts ON r_objt_metamap (modify_ts);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_infosquito2_meta_modify_ts ON r_meta_main (modify_ts);
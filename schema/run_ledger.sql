@@ -0,0 +1,24 @@
+-- Tables for the infosquito2 run ledger (infosquito.run_ledger), which records the progress of full
+-- reindex runs. infosquito2 doesn't create these itself; apply this as a migration to the DE metadata
+-- database, in the schema named by db.schema, before enabling the ledger.
+
+CREATE TABLE IF NOT EXISTS infosquito_runs (
+    run_id text PRIMARY KEY,
+    started_on timestamp with time zone NOT NULL DEFAULT now(),
+    dry_run boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS infosquito_run_prefixes (
+    run_id text NOT NULL REFERENCES infosquito_runs (run_id) ON DELETE CASCADE,
+    prefix text NOT NULL,
+    status text NOT NULL,
+    row_count bigint NOT NULL DEFAULT 0,
+    documents bigint NOT NULL DEFAULT 0,
+    added bigint NOT NULL DEFAULT 0,
+    updated bigint NOT NULL DEFAULT 0,
+    removed bigint NOT NULL DEFAULT 0,
+    duration_ms bigint NOT NULL DEFAULT 0,
+    error text,
+    updated_on timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (run_id, prefix)
+);
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyverse-de/messaging/v12"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const readinessTimeout = 5 * time.Second
+
+// statusServer serves health, readiness, and admin endpoints over HTTP
+type statusServer struct {
+	mu     sync.Mutex
+	names  []string
+	checks map[string]func(context.Context) error
+
+	// ready is set once the service has finished starting up
+	ready atomic.Bool
+
+	// liveness fails /healthz if it returns an error, e.g. when message handling has stalled
+	liveness func() error
+
+	// adminToken must be given as a bearer token to use the admin endpoints, which are disabled if it's empty
+	adminToken string
+
+	// publishClient is used by the admin endpoints, which are unavailable while it's nil
+	publishClient *messaging.Client
+	deadLetters   *deadLetterQueue
+}
+
+func newStatusServer(adminToken string) *statusServer {
+	return &statusServer{checks: make(map[string]func(context.Context) error), adminToken: adminToken}
+}
+
+// addCheck registers a named dependency check for /readyz
+func (s *statusServer) addCheck(name string, check func(context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.checks[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.checks[name] = check
+}
+
+// setLiveness registers the check /healthz uses to decide whether the service needs restarting
+func (s *statusServer) setLiveness(check func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveness = check
+}
+
+// setPublishClient enables the admin endpoints, which publish index messages with the given client
+// and manage the given dead-letter queue
+func (s *statusServer) setPublishClient(client *messaging.Client, deadLetters *deadLetterQueue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.publishClient = client
+	s.deadLetters = deadLetters
+}
+
+// queueLookup reports whether a queue exists. *messaging.Client satisfies it.
+type queueLookup interface {
+	QueueExists(name string, durable, autoDelete bool) (bool, error)
+}
+
+// amqpCheck returns a readiness check for a messaging client, which fails if the client can't open a channel
+// or the queue doesn't exist
+func amqpCheck(client queueLookup, queue string) func(context.Context) error {
+	return func(context.Context) error {
+		exists, err := client.QueueExists(queue, true, false)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("queue %s does not exist", queue)
+		}
+		return nil
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed writing HTTP response: %s", err)
+	}
+}
+
+func (s *statusServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	liveness := s.liveness
+	s.mu.Unlock()
+
+	if liveness != nil {
+		if err := liveness(); err != nil {
+			log.Errorf("Liveness check failed: %s", err)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// requireAdmin only lets requests carrying the admin token through to handler
+func (s *statusServer) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin endpoints are disabled, set infosquito.admin_token to enable them"})
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "a valid admin token is required"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *statusServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	names := append([]string(nil), s.names...)
+	checks := make(map[string]func(context.Context) error, len(s.checks))
+	for name, check := range s.checks {
+		checks[name] = check
+	}
+	s.mu.Unlock()
+
+	status := http.StatusOK
+	results := make(map[string]string, len(names)+1)
+	if !s.ready.Load() {
+		status = http.StatusServiceUnavailable
+		results["startup"] = "in progress"
+	}
+	for _, name := range names {
+		if err := checks[name](ctx); err != nil {
+			log.Errorf("Readiness check %s failed: %s", name, err)
+			status = http.StatusServiceUnavailable
+			results[name] = err.Error()
+		} else {
+			results[name] = "ok"
+		}
+	}
+
+	writeJSON(w, status, results)
+}
+
+// publishAdmin publishes an index message on behalf of an admin request
+func (s *statusServer) publishAdmin(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	client := s.publishClient
+	s.mu.Unlock()
+
+	if client == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "admin reindexing is only available in periodic mode"})
+		return
+	}
+
+	msg := indexMessage{DryRun: r.URL.Query().Get("dry_run") == "true"}
+	body, err := msg.encode()
+	if err == nil {
+		err = client.PublishContext(r.Context(), key, body)
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed publishing %s for admin request", key))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Infof("Published %s for admin request", key)
+	writeJSON(w, http.StatusAccepted, map[string]string{"published": key})
+}
+
+func (s *statusServer) handleReindexPrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.PathValue("prefix")
+	if !isHexPrefix(prefix) || len(prefix) > maxPrefixLength {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid prefix %q", prefix)})
+		return
+	}
+	s.publishAdmin(w, r, fmt.Sprintf("%s.%s", prefixRoutingKey, prefix))
+}
+
+func (s *statusServer) handleReindexObject(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	if !isUUID(uuid) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid object UUID %q", uuid)})
+		return
+	}
+	s.publishAdmin(w, r, fmt.Sprintf("%s.%s", objectRoutingKey, strings.ToLower(uuid)))
+}
+
+func (s *statusServer) handleReindexTags(w http.ResponseWriter, r *http.Request) {
+	s.publishAdmin(w, r, "index.tags")
+}
+
+// deadLetterQueue returns the dead-letter queue, writing an error response if it isn't available
+func (s *statusServer) deadLetterQueue(w http.ResponseWriter) *deadLetterQueue {
+	s.mu.Lock()
+	q := s.deadLetters
+	s.mu.Unlock()
+
+	if q == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "dead letters are only available in periodic mode"})
+	}
+	return q
+}
+
+func (s *statusServer) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	q := s.deadLetterQueue(w)
+	if q == nil {
+		return
+	}
+
+	letters, err := q.list()
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed listing dead letters"))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if letters == nil {
+		letters = []deadLetter{}
+	}
+	writeJSON(w, http.StatusOK, letters)
+}
+
+func (s *statusServer) handleReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	q := s.deadLetterQueue(w)
+	if q == nil {
+		return
+	}
+
+	n, err := q.replay(r.Context())
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed replaying dead letters"))
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "replayed": n})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"replayed": n})
+}
+
+func (s *statusServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("POST /admin/reindex/prefix/{prefix}", s.requireAdmin(s.handleReindexPrefix))
+	mux.HandleFunc("POST /admin/reindex/object/{uuid}", s.requireAdmin(s.handleReindexObject))
+	mux.HandleFunc("POST /admin/reindex/tags", s.requireAdmin(s.handleReindexTags))
+	mux.HandleFunc("GET /admin/dead-letters", s.requireAdmin(s.handleListDeadLetters))
+	mux.HandleFunc("POST /admin/dead-letters/replay", s.requireAdmin(s.handleReplayDeadLetters))
+	return mux
+}
+
+// listen starts serving on the given port in the background
+func (s *statusServer) listen(port int) *http.Server {
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Infof("Listening for HTTP requests on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("HTTP server failed: %s", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusServerReadyz(t *testing.T) {
+	cases := []struct {
+		name     string
+		ready    bool
+		checkErr error
+		expected int
+	}{
+		{"ready", true, nil, http.StatusOK},
+		{"starting", false, nil, http.StatusServiceUnavailable},
+		{"failing-check", true, errors.New("boom"), http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newStatusServer("")
+			s.ready.Store(c.ready)
+			s.addCheck("dep", func(context.Context) error { return c.checkErr })
+
+			rec := httptest.NewRecorder()
+			s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != c.expected {
+				t.Errorf("Got status %d instead of expected %d", rec.Code, c.expected)
+			}
+		})
+	}
+}
+
+// fakeQueues is a queueLookup answering from a fixed result
+type fakeQueues struct {
+	exists bool
+	err    error
+}
+
+func (f fakeQueues) QueueExists(name string, durable, autoDelete bool) (bool, error) {
+	return f.exists, f.err
+}
+
+func TestAMQPCheck(t *testing.T) {
+	cases := []struct {
+		name     string
+		queues   fakeQueues
+		expected int
+	}{
+		{"queue exists", fakeQueues{exists: true}, http.StatusOK},
+		{"queue missing", fakeQueues{exists: false}, http.StatusServiceUnavailable},
+		{"broker unavailable", fakeQueues{err: errors.New("connection closed")}, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newStatusServer("")
+			s.ready.Store(true)
+			s.addCheck("amqp-publish", amqpCheck(c.queues, "infosquito2"))
+
+			rec := httptest.NewRecorder()
+			s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != c.expected {
+				t.Errorf("Got status %d instead of expected %d", rec.Code, c.expected)
+			}
+		})
+	}
+}
+
+func TestStatusServerHealthz(t *testing.T) {
+	cases := []struct {
+		name     string
+		liveness func() error
+		expected int
+	}{
+		{"no-check", nil, http.StatusOK},
+		{"alive", func() error { return nil }, http.StatusOK},
+		{"stalled", func() error { return errors.New("stalled") }, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newStatusServer("")
+			if c.liveness != nil {
+				s.setLiveness(c.liveness)
+			}
+
+			rec := httptest.NewRecorder()
+			s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != c.expected {
+				t.Errorf("Got status %d instead of expected %d", rec.Code, c.expected)
+			}
+		})
+	}
+}
+
+func TestStatusServerAdmin(t *testing.T) {
+	cases := []struct {
+		name     string
+		token    string
+		auth     string
+		path     string
+		expected int
+	}{
+		{"invalid-prefix", "secret", "Bearer secret", "/admin/reindex/prefix/xyz", http.StatusBadRequest},
+		{"long-prefix", "secret", "Bearer secret", "/admin/reindex/prefix/" + strings.Repeat("a", maxPrefixLength+1), http.StatusBadRequest},
+		{"no-publisher", "secret", "Bearer secret", "/admin/reindex/prefix/0a1", http.StatusServiceUnavailable},
+		{"tags-no-publisher", "secret", "Bearer secret", "/admin/reindex/tags", http.StatusServiceUnavailable},
+		{"no-token", "secret", "", "/admin/reindex/tags", http.StatusUnauthorized},
+		{"wrong-token", "secret", "Bearer guess", "/admin/reindex/tags", http.StatusUnauthorized},
+		{"disabled", "", "Bearer ", "/admin/reindex/tags", http.StatusForbidden},
+		{"dead-letters-no-token", "secret", "", "/admin/dead-letters/replay", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newStatusServer(c.token)
+			req := httptest.NewRequest(http.MethodPost, c.path, nil)
+			if c.auth != "" {
+				req.Header.Set("Authorization", c.auth)
+			}
+			rec := httptest.NewRecorder()
+			s.routes().ServeHTTP(rec, req)
+			if rec.Code != c.expected {
+				t.Errorf("Got status %d instead of expected %d", rec.Code, c.expected)
+			}
+		})
+	}
+}
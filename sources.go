@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// objectRows iterates over (id, JSON document) rows of data objects or collections. *sql.Rows satisfies it.
+type objectRows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Close() error
+	Err() error
+}
+
+// objectSource is where the data objects and collections to index come from, normally the ICAT
+type objectSource interface {
+	// SelectPrefix selects the objects whose UUIDs start with prefix, returning how many UUIDs matched.
+	// The selection must be closed once the caller is done with it.
+	SelectPrefix(ctx context.Context, log *logrus.Entry, prefix string) (objectSelection, int64, error)
+}
+
+// objectSelection is a consistent view of a set of selected objects
+type objectSelection interface {
+	// Prepare collects the permissions and metadata of the selected objects, and must be called before reading them
+	Prepare(ctx context.Context, log *logrus.Entry) error
+
+	// DataObjects returns the documents for the selected data objects in the given zone, ordered by ID
+	DataObjects(ctx context.Context, irodsZone string) (objectRows, error)
+
+	// Collections returns the documents for the selected collections in the given zone, ordered by ID
+	Collections(ctx context.Context, irodsZone string) (objectRows, error)
+
+	// Close releases the selection. It's safe to call more than once.
+	Close()
+}
+
+// metadataSource is where CyVerse metadata and tags come from, normally the DE database
+type metadataSource interface {
+	// PrefixAVUs returns the CyVerse metadata JSON for each file or folder whose UUID starts with prefix
+	PrefixAVUs(ctx context.Context, prefix string) (map[string]string, error)
+
+	// TagRows returns every tag as it should be indexed
+	TagRows(ctx context.Context, irodsZone string) ([]tagRow, error)
+}
+
+// highWaterMarkStore is where the incremental reindex's high-water mark is kept, normally the DE database
+type highWaterMarkStore interface {
+	// loadHighWaterMark returns the time of the last successful incremental reindex, or the current time less lookback if there isn't one
+	loadHighWaterMark(ctx context.Context, lookback time.Duration) (time.Time, error)
+
+	// saveHighWaterMark records the time of a successful incremental reindex, never moving the mark backwards
+	saveHighWaterMark(ctx context.Context, mark time.Time) error
+}
+
+// icatSelection is an objectSelection backed by temporary tables in an ICAT transaction
+type icatSelection struct {
+	tx  *ICATTx
+	log *logrus.Entry
+}
+
+// SelectPrefix fills the base_object_uuids table with the UUIDs starting with prefix in a new transaction
+func (d *ICATConnection) SelectPrefix(ctx context.Context, log *logrus.Entry, prefix string) (objectSelection, int64, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	sel := &icatSelection{tx: tx, log: log}
+
+	r, err := createBaseUuidsTable(ctx, log, prefix, tx)
+	if err != nil {
+		sel.Close()
+		return nil, r, err
+	}
+	return sel, r, nil
+}
+
+func (s *icatSelection) Prepare(ctx context.Context, log *logrus.Entry) error {
+	if err := createObjectUuidsTable(ctx, s.tx); err != nil {
+		return err
+	}
+	if err := createPermsTable(ctx, log, s.tx); err != nil {
+		return err
+	}
+	return createMetadataTable(ctx, log, s.tx)
+}
+
+func (s *icatSelection) DataObjects(ctx context.Context, irodsZone string) (objectRows, error) {
+	return s.tx.GetDataObjects(ctx, "object_uuids", "object_perms", "object_metadata", irodsZone)
+}
+
+func (s *icatSelection) Collections(ctx context.Context, irodsZone string) (objectRows, error) {
+	return s.tx.GetCollections(ctx, "object_uuids", "object_perms", "object_metadata", irodsZone)
+}
+
+func (s *icatSelection) Close() {
+	err := s.tx.tx.Rollback()
+	if err != nil && err.Error() != "sql: transaction has already been committed or rolled back" {
+		s.log.Debugf("Failed rolling back ICAT transaction: %s", err.Error())
+	}
+}
+
+// PrefixAVUs reads the CyVerse metadata for a prefix in its own transaction
+func (d *DEDBConnection) PrefixAVUs(ctx context.Context, prefix string) (map[string]string, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer logIfErr(tx.tx.Rollback, "rolling back DE transaction")
+
+	avusRows, err := tx.GetAVUs(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer logIfErr(avusRows.Close, "closing AVUs rows")
+
+	return preprocessMetadata(avusRows)
+}
+
+// TagRows reads every tag in its own transaction
+func (d *DEDBConnection) TagRows(ctx context.Context, irodsZone string) ([]tagRow, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer logIfErr(tx.tx.Rollback, "rolling back DE transaction")
+
+	return getTagRows(ctx, tx, irodsZone)
+}
@@ -3,94 +3,296 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"strings"
 	"time"
 
-	"github.com/cyverse-de/esutils/v3"
-	"github.com/olivere/elastic/v7"
+	set "github.com/deckarep/golang-set"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 )
 
+// TagTarget is a file or folder a tag is attached to
+type TagTarget struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// tagTimestamp holds a tag date as it was indexed. The DE database produces date strings, but they
+// may have been indexed as epoch milliseconds by something else, so either is accepted and kept as text.
+type tagTimestamp string
+
+func (t *tagTimestamp) UnmarshalJSON(b []byte) error {
+	*t = tagTimestamp(strings.Trim(string(b), `"`))
+	return nil
+}
+
+// ElasticsearchTag encodes the data for a tag as it's sent to Elasticsearch
 type ElasticsearchTag struct {
-	DocType      string `json:"doc_type"`
-	ID           string `json:"id"`
-	Value        string `json:"value"`
-	Description  string `json:"description"`
-	Creator      string `json:"creator"`
-	FileType     string `json:"fileType"`
-	DateCreated  int64  `json:"dateCreated"`
-	DateModified int64  `json:"dateModified"`
+	DocType      string       `json:"doc_type"`
+	ID           string       `json:"id"`
+	Value        string       `json:"value"`
+	Description  string       `json:"description"`
+	Creator      string       `json:"creator"`
+	FileType     string       `json:"fileType"`
+	DateCreated  tagTimestamp `json:"dateCreated"`
+	DateModified tagTimestamp `json:"dateModified"`
+	Targets      []TagTarget  `json:"targets"`
+}
+
+func targetsEqual(one, two []TagTarget) bool {
+	om := make([]interface{}, len(one))
+	for i := range one {
+		om[i] = one[i]
+	}
+	tm := make([]interface{}, len(two))
+	for i := range two {
+		tm[i] = two[i]
+	}
+	return set.NewSetFromSlice(om).Equal(set.NewSetFromSlice(tm))
+}
+
+// Diff returns the JSON names of the fields which differ between two ElasticsearchTag values, or nil if they are equivalent
+func (tag ElasticsearchTag) Diff(other ElasticsearchTag) []string {
+	var fields []string
+
+	if tag.DateModified != other.DateModified {
+		fields = append(fields, "dateModified")
+	}
+	if !targetsEqual(tag.Targets, other.Targets) {
+		fields = append(fields, "targets")
+	}
+	if tag.Value != other.Value {
+		fields = append(fields, "value")
+	}
+	if tag.Description != other.Description {
+		fields = append(fields, "description")
+	}
+	if tag.ID != other.ID {
+		fields = append(fields, "id")
+	}
+	if tag.Creator != other.Creator {
+		fields = append(fields, "creator")
+	}
+	if tag.DateCreated != other.DateCreated {
+		fields = append(fields, "dateCreated")
+	}
+	if tag.DocType != other.DocType {
+		fields = append(fields, "doc_type")
+	}
+	return fields
+}
+
+// classifyTag decides what to do with a tag, returning the fields that differ from the indexed copy for updates
+func classifyTag(id string, tag ElasticsearchTag, esDocs map[string]ElasticsearchTag) (DocumentClassification, []string) {
+	indexed, ok := esDocs[id]
+	if !ok {
+		return IndexDocument, nil
+	}
+	if diff := tag.Diff(indexed); len(diff) > 0 {
+		return UpdateDocument, diff
+	}
+	return NoAction, nil
 }
 
+// tagFields are the source fields fetched from ES for ElasticsearchTag values
+var tagFields = []string{"doc_type", "id", "value", "description", "creator", "fileType", "dateCreated", "dateModified", "targets"}
+
 func logTagTime(prefixlog *logrus.Entry, start time.Time, rows *rowMetadata) {
-	prefixlog.Infof("Processed %d entries (%d rows, %d documents, %d tags indexed, %d tags removed) in %s", rows.processed, rows.rows, rows.documents, rows.tags, rows.tagsRemoved, time.Since(start).String())
+	prefixlog.Infof("Processed %d entries (%d rows, %d documents, %d tags (+%d,U%d,=%d,-%d), %d missing targets dropped) in %s", rows.processed, rows.rows, rows.documents, rows.tags, rows.tagsAdded, rows.tagsUpdated, rows.tagsUnchanged, rows.tagsRemoved, rows.tagTargetsDropped, time.Since(start).String())
 }
 
-func getIndexedTags(context context.Context, es *ESConnection) (int64, map[string]ElasticsearchTag, error) {
+func getIndexedTags(context context.Context, es searchSink) (int64, map[string]ElasticsearchTag, error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "getIndexedTags")
 	defer span.End()
 
 	docs := make(map[string]ElasticsearchTag)
 
-	query := elastic.NewBoolQuery().
-		Must(elastic.NewTermQuery("doc_type", "tag"))
+	query := searchQuery{"bool": map[string]interface{}{
+		"must": map[string]interface{}{"term": map[string]interface{}{"doc_type": "tag"}},
+	}}
+
+	var total int64
+	err := es.SearchAll(ctx, query, tagFields, func(t int64, hits []searchHit) error {
+		total = t
+		progress.beat()
+		for _, hit := range hits {
+			var doc ElasticsearchTag
+			err := json.Unmarshal(hit.Source, &doc)
+			if err != nil {
+				// if it broke, just reindex the thing
+				continue
+			}
 
-	searchService := es.es.Search(es.index).Query(query).Sort("id", true)
-	search, err := searchService.Do(ctx)
+			docs[hit.ID] = doc
+		}
+		return nil
+	})
 	if err != nil {
 		return 0, nil, err
 	}
+	return total, docs, nil
+}
 
-	for _, hit := range search.Hits.Hits {
-		var doc ElasticsearchTag
-		b, _ := hit.Source.MarshalJSON()
-		err := json.Unmarshal(b, &doc)
+// tagRow is a tag as selected from the DE database
+type tagRow struct {
+	id   string
+	json string
+}
+
+// getTagRows selects every tag from the DE database
+func getTagRows(ctx context.Context, tx *DEDBTx, irodsZone string) ([]tagRow, error) {
+	tags, err := tx.GetTags(ctx, irodsZone)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error fetching tags")
+	}
+	defer logIfErr(tags.Close, "closing tags rows")
+
+	var selected []tagRow
+	for tags.Next() {
+		var t tagRow
+		if err = tags.Scan(&t.id, &t.json); err != nil {
+			return nil, errors.Wrap(err, "Error scanning row")
+		}
+		selected = append(selected, t)
+	}
+	return selected, tags.Err()
+}
+
+// dropMissingTargets removes targets from the selected tags whose UUIDs no longer belong to anything in the ICAT
+func dropMissingTargets(context context.Context, log *logrus.Entry, rows *rowMetadata, icat *ICATConnection, selected []tagRow) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "dropMissingTargets")
+	defer span.End()
+
+	idSet := make(map[string]bool)
+	for _, t := range selected {
+		var tag ElasticsearchTag
+		if err := json.Unmarshal([]byte(t.json), &tag); err != nil {
+			// leave it alone, it'll be reindexed as it is
+			continue
+		}
+		for _, target := range tag.Targets {
+			idSet[strings.ToLower(target.ID)] = true
+		}
+	}
+	if len(idSet) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(idSet))
+	for id := range idSet {
+		ids = append(ids, id)
+	}
+	existing, err := icat.ExistingUUIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range selected {
+		kept, dropped, err := keepTargets(selected[i].json, existing)
 		if err != nil {
-			// if it broke, just reindex the thing
+			log.Debugf("Unable to validate targets for tag %s, leaving them: %s", selected[i].id, err)
 			continue
 		}
+		if dropped > 0 {
+			selected[i].json = kept
+			rows.tagTargetsDropped += dropped
+			log.Debugf("Dropped %d targets missing from the ICAT from tag %s", dropped, selected[i].id)
+		}
+	}
+	return nil
+}
 
-		docs[hit.Id] = doc
+// keepTargets returns the tag JSON with only the targets whose lowercase UUIDs are in existing, and how many were dropped.
+// The JSON is returned unchanged if nothing was dropped.
+func keepTargets(tagJSON string, existing map[string]bool) (string, int64, error) {
+	var tag ElasticsearchTag
+	if err := json.Unmarshal([]byte(tagJSON), &tag); err != nil {
+		return tagJSON, 0, err
+	}
+
+	kept := make([]TagTarget, 0, len(tag.Targets))
+	for _, target := range tag.Targets {
+		if existing[strings.ToLower(target.ID)] {
+			kept = append(kept, target)
+		}
 	}
-	return search.TotalHits(), docs, nil
+	if len(kept) == len(tag.Targets) {
+		return tagJSON, 0, nil
+	}
+
+	// only replace the targets, leaving the rest of the document exactly as selected
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(tagJSON), &doc); err != nil {
+		return tagJSON, 0, err
+	}
+	targets, err := json.Marshal(kept)
+	if err != nil {
+		return tagJSON, 0, err
+	}
+	doc["targets"] = targets
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return tagJSON, 0, err
+	}
+	return string(b), int64(len(tag.Targets) - len(kept)), nil
 }
 
-func processTags(context context.Context, log *logrus.Entry, rows *rowMetadata, seenDocs map[string]bool, indexer *esutils.BulkIndexer, es *ESConnection, tx *DEDBTx, irodsZone string) error {
+func processTags(context context.Context, log *logrus.Entry, rows *rowMetadata, esDocs map[string]ElasticsearchTag, seenDocs map[string]bool, indexer bulkIndexer, icat *ICATConnection, selected []tagRow) error {
 	ctx, span := otel.Tracer(otelName).Start(context, "processTags")
 	defer span.End()
 
-	tags, err := tx.GetTags(ctx, irodsZone)
-	if err != nil {
-		return errors.Wrap(err, "Error fetching tags")
-	}
-	defer logIfErr(tags.Close, "closing tags rows")
-	for tags.Next() {
-		var id, selectedJSON string
-		if err = tags.Scan(&id, &selectedJSON); err != nil {
-			return errors.Wrap(err, "Error scanning row")
+	var err error
+	if icat != nil {
+		if err = dropMissingTargets(ctx, log, rows, icat, selected); err != nil {
+			return errors.Wrap(err, "Error validating tag targets")
 		}
+	}
 
-		seenDocs[id] = true
-		if err = index(indexer, es.index, id, selectedJSON); err != nil {
-			return err
-		}
+	for _, t := range selected {
+		progress.beat()
+		id, selectedJSON := t.id, t.json
 
+		seenDocs[id] = true
 		rows.processed++
 		rows.tags++
+
+		var tag ElasticsearchTag
+		classification, fields := UpdateDocument, []string(nil)
+		if err = json.Unmarshal([]byte(selectedJSON), &tag); err != nil {
+			// can't compare it, so just reindex it
+			log.Debugf("Unable to decode tag %s, reindexing it: %s", id, err)
+		} else {
+			classification, fields = classifyTag(id, tag, esDocs)
+		}
+
+		switch classification {
+		case NoAction:
+			rows.tagsUnchanged++
+			continue
+		case IndexDocument:
+			rows.tagsAdded++
+		case UpdateDocument:
+			rows.tagsUpdated++
+		}
+
+		rows.plan(id, "tag", classification, fields)
+		if err = indexer.Index(id, selectedJSON); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func processTagDeletions(context context.Context, log *logrus.Entry, rows *rowMetadata, esDocs map[string]ElasticsearchTag, seenDocs map[string]bool, indexer *esutils.BulkIndexer, es *ESConnection) error {
+func processTagDeletions(context context.Context, log *logrus.Entry, rows *rowMetadata, esDocs map[string]ElasticsearchTag, seenDocs map[string]bool, indexer bulkIndexer) error {
 	_, span := otel.Tracer(otelName).Start(context, "processTagDeletions")
 	defer span.End()
 
 	for id := range esDocs {
 		if !seenDocs[id] {
 			rows.tagsRemoved++
-			req := elastic.NewBulkDeleteRequest().Index(es.index).Id(id)
-			err := indexer.Add(req)
+			rows.planDelete(id, "tag")
+			err := indexer.Delete(id)
 			if err != nil {
 				return errors.Wrap(err, "Got error adding delete to indexer")
 			}
@@ -100,12 +302,20 @@ func processTagDeletions(context context.Context, log *logrus.Entry, rows *rowMe
 	return nil
 }
 
-// ReindexTags attempts to reindex tags given a DB and ES connection
-func ReindexTags(context context.Context, db *DEDBConnection, es *ESConnection, irodsZone string) error {
+// ReindexTags attempts to reindex tags given a metadata source and search sink. If icat is not nil, targets
+// whose UUIDs are no longer in the ICAT are dropped from the indexed tags.
+func ReindexTags(context context.Context, db metadataSource, icat *ICATConnection, es searchSink, irodsZone string, opts ReindexOptions) error {
+	var rows rowMetadata
+	return reindexTags(context, db, icat, es, irodsZone, opts, &rows)
+}
+
+func reindexTags(context context.Context, db metadataSource, icat *ICATConnection, es searchSink, irodsZone string, opts ReindexOptions, rows *rowMetadata) (err error) {
 	ctx, span := otel.Tracer(otelName).Start(context, "ReindexTags")
 	defer span.End()
 
-	var rows rowMetadata
+	if opts.DryRun {
+		rows.report = newDryRunReport("tags", "")
+	}
 
 	taglog := log.WithFields(logrus.Fields{
 		"operation": "indexTags",
@@ -113,7 +323,8 @@ func ReindexTags(context context.Context, db *DEDBConnection, es *ESConnection,
 	taglog.Debug("Indexing tags")
 
 	start := time.Now()
-	defer logTagTime(taglog, start, &rows)
+	defer logTagTime(taglog, start, rows)
+	defer func() { observeReindex("tags", start, rows, err) }()
 
 	// Get existing stuff from ES
 	seenDocs := make(map[string]bool)
@@ -123,39 +334,27 @@ func ReindexTags(context context.Context, db *DEDBConnection, es *ESConnection,
 		return errors.Wrap(err, "Error fetching indexed tags")
 	}
 
-	tx, err := db.BeginTx(ctx, nil)
+	selected, err := db.TagRows(ctx, irodsZone)
 	if err != nil {
-		return errors.Wrap(err, "Error starting transaction")
+		return err
 	}
-	rb := func() {
-		err := tx.tx.Rollback()
-		if err != nil && err.Error() != "sql: transaction has already been committed or rolled back" {
-			taglog.Debugf("Failed rolling back transaction: %s", err.Error())
-		}
-	}
-	defer rb()
 
-	// Index tags that exist (just do them all, don't worry about classifying updates/deletes or skipping unchanged)
-	indexer := es.NewBulkIndexer(ctx, 1000)
-	defer logIfErr(indexer.Flush, "flushing tags bulk indexer (deferred)")
+	// Index tags that are new or have changed
+	indexer := newIndexer(ctx, es, opts)
+	defer logIfErr(func() error { return flushIfPending(indexer) }, "flushing tags bulk indexer (deferred)")
 
-	if err = processTags(ctx, taglog, &rows, seenDocs, indexer, es, tx, irodsZone); err != nil {
+	if err = processTags(ctx, taglog, rows, esDocs, seenDocs, indexer, icat, selected); err != nil {
 		return errors.Wrap(err, "Error processing tags")
 	}
 
-	rb() // roll back before doing deletions to release DB locks
-
 	// Delete tags that didn't appear in the database query
-	if err = processTagDeletions(ctx, taglog, &rows, esDocs, seenDocs, indexer, es); err != nil {
+	if err = processTagDeletions(ctx, taglog, rows, esDocs, seenDocs, indexer); err != nil {
 		return errors.Wrap(err, "Error deleting tags")
 	}
 
-	if indexer.CanFlush() {
-		err = indexer.Flush()
-		if err != nil {
-			return errors.Wrap(err, "Got error flushing bulk indexer")
-		}
+	if err = flushIfPending(indexer); err != nil {
+		return errors.Wrap(err, "Got error flushing bulk indexer")
 	}
 
-	return nil
+	return rows.report.emit()
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestClassifyTag(t *testing.T) {
+	indexed := map[string]ElasticsearchTag{
+		"1": {
+			DocType: "tag", ID: "1", Value: "foo", Creator: "ipcdev#iplant",
+			DateCreated: "2020-01-01T00:00:00", DateModified: "2020-01-02T00:00:00",
+			Targets: []TagTarget{{"a", "file"}, {"b", "folder"}},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		id       string
+		tag      ElasticsearchTag
+		expected DocumentClassification
+		fields   string
+	}{
+		{"new", "2", ElasticsearchTag{ID: "2"}, IndexDocument, ""},
+		{"unchanged", "1", ElasticsearchTag{
+			DocType: "tag", ID: "1", Value: "foo", Creator: "ipcdev#iplant",
+			DateCreated: "2020-01-01T00:00:00", DateModified: "2020-01-02T00:00:00",
+			Targets: []TagTarget{{"b", "folder"}, {"a", "file"}},
+		}, NoAction, ""},
+		{"targets", "1", ElasticsearchTag{
+			DocType: "tag", ID: "1", Value: "foo", Creator: "ipcdev#iplant",
+			DateCreated: "2020-01-01T00:00:00", DateModified: "2020-01-02T00:00:00",
+			Targets: []TagTarget{{"a", "file"}},
+		}, UpdateDocument, "targets"},
+		{"value", "1", ElasticsearchTag{
+			DocType: "tag", ID: "1", Value: "bar", Creator: "ipcdev#iplant",
+			DateCreated: "2020-01-01T00:00:00", DateModified: "2020-01-03T00:00:00",
+			Targets: []TagTarget{{"a", "file"}, {"b", "folder"}},
+		}, UpdateDocument, "dateModified,value"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			classification, fields := classifyTag(c.id, c.tag, indexed)
+			if classification != c.expected {
+				t.Errorf("Got classification %d instead of expected %d", classification, c.expected)
+			}
+			if got := strings.Join(fields, ","); got != c.fields {
+				t.Errorf("Got fields %q instead of expected %q", got, c.fields)
+			}
+		})
+	}
+}
+
+func TestTagTimestampUnmarshal(t *testing.T) {
+	var tags []ElasticsearchTag
+	err := json.Unmarshal([]byte(`[{"dateCreated": "2020-01-01T00:00:00.5"}, {"dateCreated": 1577836800500}]`), &tags)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if tags[0].DateCreated != "2020-01-01T00:00:00.5" || tags[1].DateCreated != "1577836800500" {
+		t.Errorf("Got %q and %q", tags[0].DateCreated, tags[1].DateCreated)
+	}
+}
+
+func TestKeepTargets(t *testing.T) {
+	existing := map[string]bool{"a": true, "b": true}
+
+	cases := []struct {
+		name    string
+		json    string
+		targets string
+		dropped int64
+	}{
+		{"all-present", `{"id": "1", "targets": [{"id": "a", "type": "file"}, {"id": "B", "type": "folder"}]}`, "a,B", 0},
+		{"some-missing", `{"id": "1", "targets": [{"id": "a", "type": "file"}, {"id": "c", "type": "folder"}]}`, "a", 1},
+		{"all-missing", `{"id": "1", "targets": [{"id": "c", "type": "file"}]}`, "", 1},
+		{"none", `{"id": "1", "targets": []}`, "", 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			kept, dropped, err := keepTargets(c.json, existing)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if dropped != c.dropped {
+				t.Errorf("Got %d dropped instead of expected %d", dropped, c.dropped)
+			}
+			if dropped == 0 && kept != c.json {
+				t.Errorf("Expected the JSON to be unchanged, got %s", kept)
+			}
+
+			var tag ElasticsearchTag
+			if err = json.Unmarshal([]byte(kept), &tag); err != nil {
+				t.Fatalf("Unexpected error decoding %s: %s", kept, err)
+			}
+			if tag.ID != "1" {
+				t.Errorf("Lost the tag ID: %s", kept)
+			}
+			var ids []string
+			for _, target := range tag.Targets {
+				ids = append(ids, target.ID)
+			}
+			if got := strings.Join(ids, ","); got != c.targets {
+				t.Errorf("Got targets %q instead of expected %q", got, c.targets)
+			}
+		})
+	}
+}
+
+func TestReindexTags(t *testing.T) {
+	tag := func(id, value string) ElasticsearchTag {
+		return ElasticsearchTag{DocType: "tag", ID: id, Value: value, Creator: "ipcdev#iplant", DateCreated: "2020-01-01T00:00:00", DateModified: "2020-01-01T00:00:00", Targets: []TagTarget{{"ab01", "file"}}}
+	}
+
+	cases := []struct {
+		name     string
+		tags     []ElasticsearchTag
+		indexed  []ElasticsearchTag
+		expected map[string]string
+		counts   [4]int64
+	}{
+		{"add", []ElasticsearchTag{tag("1", "foo")}, nil, map[string]string{"1": "foo"}, [4]int64{1, 0, 0, 0}},
+		{"update", []ElasticsearchTag{tag("1", "bar")}, []ElasticsearchTag{tag("1", "foo")}, map[string]string{"1": "bar"}, [4]int64{0, 1, 0, 0}},
+		{"unchanged", []ElasticsearchTag{tag("1", "foo")}, []ElasticsearchTag{tag("1", "foo")}, map[string]string{"1": "foo"}, [4]int64{0, 0, 1, 0}},
+		{"delete", []ElasticsearchTag{tag("1", "foo")}, []ElasticsearchTag{tag("1", "foo"), tag("2", "bar")}, map[string]string{"1": "foo"}, [4]int64{0, 0, 1, 1}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			indexed := make([]interface{}, len(c.indexed))
+			for i, tag := range c.indexed {
+				indexed[i] = tag
+			}
+			es, err := newFakeSearch(indexed...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rows rowMetadata
+			err = reindexTags(context.Background(), fakeMetadata{tags: c.tags}, nil, es, "iplant", ReindexOptions{}, &rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := [4]int64{rows.tagsAdded, rows.tagsUpdated, rows.tagsUnchanged, rows.tagsRemoved}
+			if got != c.counts {
+				t.Errorf("Got counts %v, expected %v", got, c.counts)
+			}
+
+			values := make(map[string]string)
+			for id, source := range es.docs {
+				var tag ElasticsearchTag
+				if err = json.Unmarshal(source, &tag); err != nil {
+					t.Fatal(err)
+				}
+				values[id] = tag.Value
+			}
+			if len(values) != len(c.expected) {
+				t.Errorf("Got tags %v, expected %v", values, c.expected)
+			}
+			for id, value := range c.expected {
+				if values[id] != value {
+					t.Errorf("Tag %s has value %q, expected %q", id, values[id], value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+-- A minimal DE database: the metadata and tag tables infosquito2 reads, in the de schema.
+DROP SCHEMA IF EXISTS de CASCADE;
+CREATE SCHEMA de;
+
+CREATE TABLE de.avus (
+    id          uuid PRIMARY KEY,
+    attribute   text,
+    value       text,
+    unit        text,
+    target_id   uuid NOT NULL,
+    target_type text NOT NULL,
+    created_by  text NOT NULL,
+    modified_by text NOT NULL,
+    created_on  timestamp NOT NULL DEFAULT now(),
+    modified_on timestamp NOT NULL DEFAULT now()
+);
+
+CREATE TABLE de.tags (
+    id          uuid PRIMARY KEY,
+    value       varchar(255) NOT NULL,
+    description text,
+    public      boolean NOT NULL DEFAULT false,
+    owner_id    varchar(512),
+    created_on  timestamp NOT NULL,
+    modified_on timestamp NOT NULL
+);
+
+CREATE TABLE de.attached_tags (
+    target_id   uuid NOT NULL,
+    target_type text NOT NULL,
+    tag_id      uuid NOT NULL,
+    attacher_id varchar(512),
+    attached_on timestamp NOT NULL DEFAULT now(),
+    detached_on timestamp
+);
+
+INSERT INTO de.avus (id, attribute, value, unit, target_id, target_type, created_by, modified_by) VALUES
+    ('aa000000-0000-0000-0000-000000000001', 'project', 'alpha', '', '1a000000-0000-0000-0000-000000000020', 'file', 'ipcdev', 'ipcdev'),
+    -- nested under the first AVU, so it belongs to the same file
+    ('aa000000-0000-0000-0000-000000000002', 'stage', 'draft', '', 'aa000000-0000-0000-0000-000000000001', 'avu', 'ipcdev', 'ipcdev'),
+    -- outside the prefix
+    ('aa000000-0000-0000-0000-000000000003', 'project', 'beta', '', '2b000000-0000-0000-0000-000000000021', 'file', 'ipcdev', 'ipcdev');
+
+INSERT INTO de.tags (id, value, description, owner_id, created_on, modified_on) VALUES
+    ('ff000000-0000-0000-0000-000000000001', 'important', 'Things that matter', 'ipcdev', '2020-01-01 00:00:00', '2020-01-02 00:00:00'),
+    ('ff000000-0000-0000-0000-000000000002', 'unused', '', 'ipcdev', '2020-01-01 00:00:00', '2020-01-01 00:00:00');
+
+INSERT INTO de.attached_tags (target_id, target_type, tag_id, attacher_id) VALUES
+    ('1a000000-0000-0000-0000-000000000020', 'file', 'ff000000-0000-0000-0000-000000000001', 'ipcdev'),
+    ('1a000000-0000-0000-0000-000000000013', 'folder', 'ff000000-0000-0000-0000-000000000001', 'ipcdev'),
+    -- only files and folders are targets
+    ('cc000000-0000-0000-0000-000000000001', 'app', 'ff000000-0000-0000-0000-000000000001', 'ipcdev');
@@ -0,0 +1,105 @@
+-- A minimal ICAT: just the tables and columns infosquito2 reads, with a handful of objects.
+-- UUIDs starting with 1a are in the prefix the tests reindex.
+DROP TABLE IF EXISTS r_objt_access, r_objt_metamap, r_meta_main, r_data_main, r_coll_main, r_user_main;
+
+CREATE TABLE r_user_main (
+    user_id   bigint PRIMARY KEY,
+    user_name varchar(250) NOT NULL,
+    zone_name varchar(250) NOT NULL
+);
+
+CREATE TABLE r_coll_main (
+    coll_id          bigint PRIMARY KEY,
+    parent_coll_name varchar(2700) NOT NULL,
+    coll_name        varchar(2700) NOT NULL,
+    coll_owner_name  varchar(250) NOT NULL,
+    coll_owner_zone  varchar(250) NOT NULL,
+    coll_type        varchar(250) DEFAULT '',
+    create_ts        varchar(32),
+    modify_ts        varchar(32)
+);
+
+CREATE TABLE r_data_main (
+    data_id         bigint NOT NULL,
+    coll_id         bigint NOT NULL,
+    data_name       varchar(1000) NOT NULL,
+    data_repl_num   integer NOT NULL,
+    data_type_name  varchar(250),
+    data_size       bigint NOT NULL,
+    data_owner_name varchar(250) NOT NULL,
+    data_owner_zone varchar(250) NOT NULL,
+    create_ts       varchar(32),
+    modify_ts       varchar(32)
+);
+
+CREATE TABLE r_meta_main (
+    meta_id         bigint PRIMARY KEY,
+    meta_attr_name  varchar(2700) NOT NULL,
+    meta_attr_value varchar(2700) NOT NULL,
+    meta_attr_unit  varchar(250),
+    modify_ts       varchar(32)
+);
+
+CREATE TABLE r_objt_metamap (
+    object_id bigint NOT NULL,
+    meta_id   bigint NOT NULL,
+    modify_ts varchar(32)
+);
+
+CREATE TABLE r_objt_access (
+    object_id      bigint NOT NULL,
+    user_id        bigint NOT NULL,
+    access_type_id bigint NOT NULL,
+    modify_ts      varchar(32)
+);
+
+INSERT INTO r_user_main VALUES
+    (1, 'ipcdev', 'iplant'),
+    (2, 'rodsadmin', 'iplant');
+
+INSERT INTO r_coll_main VALUES
+    (11, '/', '/iplant', 'rodsadmin', 'iplant', '', '01500000000', '01500000000'),
+    (12, '/iplant', '/iplant/home', 'rodsadmin', 'iplant', '', '01500000000', '01500000000'),
+    (13, '/iplant/home', '/iplant/home/ipcdev', 'ipcdev', 'iplant', '', '01500000000', '01600000000'),
+    -- not a plain collection, so never indexed
+    (14, '/iplant/home/ipcdev', '/iplant/home/ipcdev/mount', 'ipcdev', 'iplant', 'mountPoint', '01500000000', '01500000000'),
+    -- outside the zone, so never indexed
+    (15, '/otherzone', '/otherzone/home', 'rodsadmin', 'otherzone', '', '01500000000', '01500000000'),
+    -- renamed after everything else, which leaves what's beneath it with old modify_ts values
+    (16, '/iplant/home', '/iplant/home/renamed_dir', 'ipcdev', 'iplant', '', '01500000000', '01700000000'),
+    (17, '/iplant/home/renamed_dir', '/iplant/home/renamed_dir/sub', 'ipcdev', 'iplant', '', '01500000000', '01500000000'),
+    -- matches renamed_dir's descendants if _ isn't escaped in the LIKE pattern
+    (18, '/iplant/home/renamedXdir', '/iplant/home/renamedXdir/sub', 'ipcdev', 'iplant', '', '01500000000', '01500000000');
+
+INSERT INTO r_data_main VALUES
+    -- two replicas, which should produce a single document
+    (20, 13, 'a.txt', 0, 'generic', 100, 'ipcdev', 'iplant', '01600000000', '01600000001'),
+    (20, 13, 'a.txt', 1, 'generic', 100, 'ipcdev', 'iplant', '01600000000', '01600000001'),
+    -- outside the prefix
+    (21, 13, 'b.txt', 0, 'generic', 200, 'ipcdev', 'iplant', '01600000000', '01600000000'),
+    -- outside the zone
+    (22, 15, 'c.txt', 0, 'generic', 300, 'rodsadmin', 'otherzone', '01600000000', '01600000000'),
+    (23, 17, 'd.txt', 0, 'generic', 400, 'ipcdev', 'iplant', '01500000000', '01500000000');
+
+INSERT INTO r_meta_main VALUES
+    (100, 'ipc_UUID', '1a000000-0000-0000-0000-000000000013', NULL),
+    (101, 'ipc_UUID', '1a000000-0000-0000-0000-000000000014', NULL),
+    (102, 'ipc_UUID', '1a000000-0000-0000-0000-000000000015', NULL),
+    (103, 'ipc_UUID', '1a000000-0000-0000-0000-000000000020', NULL),
+    (104, 'ipc_UUID', '2b000000-0000-0000-0000-000000000021', NULL),
+    (105, 'ipc_UUID', '1a000000-0000-0000-0000-000000000022', NULL),
+    (106, 'ipc_UUID', '3c000000-0000-0000-0000-000000000016', NULL),
+    (107, 'ipc_UUID', '3c000000-0000-0000-0000-000000000017', NULL),
+    (108, 'ipc_UUID', '3c000000-0000-0000-0000-000000000018', NULL),
+    (109, 'ipc_UUID', '3c000000-0000-0000-0000-000000000023', NULL),
+    (110, 'color', 'blue', 'hue');
+
+INSERT INTO r_objt_metamap VALUES
+    (13, 100), (14, 101), (15, 102), (20, 103), (21, 104), (22, 105), (20, 110),
+    (16, 106), (17, 107), (18, 108), (23, 109);
+
+INSERT INTO r_objt_access VALUES
+    (13, 1, 1200),
+    (20, 1, 1200),
+    (20, 2, 1050),
+    (21, 1, 1120);
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+)
+
+const userRoutingKey string = "index.user"
+
+// splitQualifiedUser splits a user#zone name, using defaultZone if no zone is given
+func splitQualifiedUser(user, defaultZone string) (string, string, error) {
+	name, zone, found := strings.Cut(user, "#")
+	if !found {
+		zone = defaultZone
+	}
+	if name == "" || zone == "" || strings.Contains(zone, "#") {
+		return "", "", errors.Errorf("Invalid user %q, expected user#zone", user)
+	}
+	return name, zone, nil
+}
+
+func createUserBaseUuidsTable(context context.Context, log *logrus.Entry, userName, userZone string, tx *ICATTx) (int64, error) {
+	ctx, span := otel.Tracer(otelName).Start(context, "createUserBaseUuidsTable")
+	defer span.End()
+
+	r, err := tx.CreateTemporaryTable(ctx, "base_object_uuids", `SELECT DISTINCT meta.meta_id, lower(meta.meta_attr_value) as id
+  FROM r_meta_main meta
+  JOIN r_objt_metamap map ON map.meta_id = meta.meta_id
+ WHERE meta.meta_attr_name = 'ipc_UUID'
+   AND map.object_id IN (SELECT a.object_id FROM r_objt_access a JOIN r_user_main u ON a.user_id = u.user_id WHERE u.user_name = $1 AND u.zone_name = $2
+                         UNION SELECT data_id FROM r_data_main WHERE data_owner_name = $1 AND data_owner_zone = $2
+                         UNION SELECT coll_id FROM r_coll_main WHERE coll_owner_name = $1 AND coll_owner_zone = $2)`, userName, userZone)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("Got %d rows for user %s#%s", r, userName, userZone)
+	return r, nil
+}
+
+// ReindexUser reindexes every data object and collection owned by the given user#zone or shared directly with them.
+// Objects shared only through a group aren't included, and deleted objects are left for the next prefix reindex to remove.
+func ReindexUser(context context.Context, icat *ICATConnection, dedb *DEDBConnection, es SearchBackend, user, irodsZone string, opts ReindexOptions) error {
+	ctx, span := otel.Tracer(otelName).Start(context, "ReindexUser")
+	defer span.End()
+
+	userName, userZone, err := splitQualifiedUser(user, irodsZone)
+	if err != nil {
+		return err
+	}
+	qualified := userName + "#" + userZone
+
+	userlog := log.WithFields(logrus.Fields{
+		"user": qualified,
+	})
+	userlog.Debugf("Indexing objects for user %s", qualified)
+
+	return reindexSelected(ctx, userlog, icat, dedb, es, userUuids(userName, userZone), nil, irodsZone, "user", qualified, opts)
+}
+
+func userUuids(userName, userZone string) baseUuidsCreator {
+	return func(ctx context.Context, log *logrus.Entry, tx *ICATTx) (int64, error) {
+		return createUserBaseUuidsTable(ctx, log, userName, userZone, tx)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestSplitQualifiedUser(t *testing.T) {
+	cases := []struct {
+		user, name, zone string
+		err              bool
+	}{
+		{"ipcdev#iplant", "ipcdev", "iplant", false},
+		{"ipcdev#otherzone", "ipcdev", "otherzone", false},
+		{"ipcdev", "ipcdev", "iplant", false},
+		{"#iplant", "", "", true},
+		{"ipcdev#", "", "", true},
+		{"ipcdev#iplant#x", "", "", true},
+		{"", "", "", true},
+	}
+
+	for _, c := range cases {
+		name, zone, err := splitQualifiedUser(c.user, "iplant")
+		if (err != nil) != c.err {
+			t.Errorf("%q: got error %v, expected error: %t", c.user, err, c.err)
+			continue
+		}
+		if name != c.name || zone != c.zone {
+			t.Errorf("%q: got %s, %s instead of expected %s, %s", c.user, name, zone, c.name, c.zone)
+		}
+	}
+}